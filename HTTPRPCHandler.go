@@ -0,0 +1,124 @@
+package wsrpc
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+)
+
+// ErrPushNotSupported is returned when a handler sends a message to the peer (eg. a call or a notification)
+// over a transport which only supports responses, such as HTTPRPCHandler.
+var ErrPushNotSupported = errors.New("server push is not supported by the transport")
+
+// DefaultMaxBodySize is the default limit of the size of an HTTP request body.
+const DefaultMaxBodySize = 1 << 20
+
+// HTTPRPCHandler is an http.Handler that serves JSON-RPC requests (a single request or a batch) sent via HTTP POST.
+//
+// Each HTTP request is processed synchronously by a transient connection,
+// which is neither tracked nor passed to OnConnect and OnDisconnect.
+// The context of the connection is derived from the HTTP request.
+// Handlers cannot send messages to the peer, ErrPushNotSupported is returned instead.
+// Each HTTP request takes a worker of the RPC service (see WebsocketRPC.MaxConcurrency),
+// while WebsocketRPC.Order does not apply across HTTP requests.
+//
+// It responds with status 200 and the responses, 204 if there is no response (eg. only notifications),
+// 400 if the body is not a valid JSON-RPC message, 401 if the HandshakeAuthenticator fails,
+// 403 if InitSession fails, 405 if the method is not POST, 413 if the body is too large,
+// 415 if the Content-Type is not JSON, and 503 with RPCServerBusyError responses
+// if the requests are rejected due to OverloadReject.
+type HTTPRPCHandler struct {
+	//RPC is a pointer to the RPC service
+	RPC *WebsocketRPC
+	//InitSession is called before processing the requests to initialize the transient connection
+	//with the HTTP request, eg. to populate the session from the headers.
+	InitSession func(rpcConn *WebsocketRPCConn, r *http.Request) error
+	//MaxBodySize limits the size in bytes of the request body, default is DefaultMaxBodySize.
+	MaxBodySize int64
+}
+
+// HTTPHandler creates an http.Handler which serves the RPC service over HTTP POST,
+// eg. `http.Handle("/rpc/http", rpc.HTTPHandler())`.
+func (rpc *WebsocketRPC) HTTPHandler() *HTTPRPCHandler {
+	return &HTTPRPCHandler{RPC: rpc}
+}
+
+// transientAdapter is used by the connection which only sends responses
+type transientAdapter struct{}
+
+func (transientAdapter) ReadMessage() ([]byte, error) {
+	return nil, io.EOF
+}
+
+func (transientAdapter) WriteMessage(data []byte) error {
+	return ErrPushNotSupported
+}
+
+// ServeHTTP processes the JSON-RPC requests in the body and writes the responses.
+func (h *HTTPRPCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	principal, err := h.RPC.AuthenticateRequest(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	maxBodySize := h.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > maxBodySize {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	h.RPC.initWorkers()
+	rpcConn := h.RPC.newConn(r.Context(), transientAdapter{}, WithPrincipal(principal))
+	defer h.release(rpcConn)
+	if h.InitSession != nil {
+		if err := h.InitSession(rpcConn, r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	response, rpcErr := rpcConn.processMessage(body)
+	status := http.StatusOK
+	if rpcErr != nil {
+		status = http.StatusBadRequest
+		if rpcErr.Code == RPCServerBusyError.Code {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	if response == nil {
+		if status == http.StatusOK {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			http.Error(w, http.StatusText(status), status)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(response)
+}
+
+// release cancels the requests and removes the subscriptions of a transient connection
+func (h *HTTPRPCHandler) release(rpcConn *WebsocketRPCConn) {
+	rpcConn.cancel()
+	h.RPC.subscriptions.removeConn(rpcConn)
+}
@@ -1,6 +1,7 @@
 package wsrpc
 
 // MessageAdapter is an adapter for rpc services to read and write messages.
+// An adapter can also implement io.Closer, which is called when the RPC connection is closed.
 type MessageAdapter interface {
 	// ReadMessage reads a message. If the connection is closed, this function must return an error.
 	ReadMessage() ([]byte, error)
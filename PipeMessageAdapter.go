@@ -0,0 +1,177 @@
+package wsrpc
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// pipeBufferSize is the number of messages buffered in each direction of a pipe
+const pipeBufferSize = 64
+
+// PipeOptions is used to simulate an unreliable network with NewPipeWithOptions.
+type PipeOptions struct {
+	//Latency delays the delivery of each message.
+	Latency time.Duration
+	//Jitter adds a random delay in [0, Jitter) to Latency.
+	Jitter time.Duration
+	//DropRate is the probability in [0, 1] that a message is silently dropped.
+	DropRate float64
+	//Reorder delivers each message independently after its own delay,
+	//so that messages can arrive out of order if Jitter is set.
+	Reorder bool
+	//Seed is the seed of the randomness, for reproducible tests.
+	Seed int64
+}
+
+// pipe is shared by both ends
+type pipe struct {
+	options   PipeOptions
+	closed    chan struct{}
+	closeOnce sync.Once
+	mux       sync.Mutex
+	rand      *rand.Rand
+}
+
+type pipeMessage struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// PipeMessageAdapter is an end of an in-memory pipe created by NewPipe.
+type PipeMessageAdapter struct {
+	pipe    *pipe
+	in      chan []byte
+	out     chan pipeMessage
+	peer    *PipeMessageAdapter
+	mux     sync.Mutex
+	lastAt  time.Time
+	started sync.Once
+}
+
+// NewPipe creates two connected adapters, messages written to one can be read from the other.
+// Closing either one closes both.
+func NewPipe() (*PipeMessageAdapter, *PipeMessageAdapter) {
+	return NewPipeWithOptions(PipeOptions{})
+}
+
+// NewPipeWithOptions is like NewPipe but simulates latency, message drop and reordering.
+func NewPipeWithOptions(options PipeOptions) (*PipeMessageAdapter, *PipeMessageAdapter) {
+	p := &pipe{
+		options: options,
+		closed:  make(chan struct{}),
+		rand:    rand.New(rand.NewSource(options.Seed))}
+	a := &PipeMessageAdapter{pipe: p, in: make(chan []byte, pipeBufferSize), out: make(chan pipeMessage, pipeBufferSize)}
+	b := &PipeMessageAdapter{pipe: p, in: make(chan []byte, pipeBufferSize), out: make(chan pipeMessage, pipeBufferSize)}
+	a.peer = b
+	b.peer = a
+	return a, b
+}
+
+// NewPipeConns creates two connections of a and b over a pipe (see NewPipeWithOptions, options can be nil),
+// both are served in new goroutines.
+func NewPipeConns(a *WebsocketRPC, b *WebsocketRPC, options *PipeOptions) (*WebsocketRPCConn, *WebsocketRPCConn) {
+	var opts PipeOptions
+	if options != nil {
+		opts = *options
+	}
+	adapterA, adapterB := NewPipeWithOptions(opts)
+	connA := a.ConnectAdapter(adapterA)
+	connB := b.ConnectAdapter(adapterB)
+	go connA.ServeConn()
+	go connB.ServeConn()
+	return connA, connB
+}
+
+// ReadMessage reads a message. If the connection is closed, this function must return an error.
+func (a *PipeMessageAdapter) ReadMessage() ([]byte, error) {
+	select {
+	case data := <-a.in:
+		return data, nil
+	case <-a.pipe.closed:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+// WriteMessage writes a message. If the connection is closed, this function must return an error.
+func (a *PipeMessageAdapter) WriteMessage(data []byte) error {
+	select {
+	case <-a.pipe.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	data = append([]byte(nil), data...)
+	options := a.pipe.options
+	delay := options.Latency
+	a.pipe.mux.Lock()
+	drop := options.DropRate > 0 && a.pipe.rand.Float64() < options.DropRate
+	if options.Jitter > 0 {
+		delay += time.Duration(a.pipe.rand.Int63n(int64(options.Jitter)))
+	}
+	a.pipe.mux.Unlock()
+	if drop {
+		return nil
+	}
+	if options.Latency <= 0 && options.Jitter <= 0 && !options.Reorder {
+		return a.deliver(data)
+	}
+	if options.Reorder {
+		time.AfterFunc(delay, func() {
+			_ = a.deliver(data)
+		})
+		return nil
+	}
+	// Keep the order by delivering messages one by one in a goroutine
+	a.started.Do(func() {
+		go a.deliverLoop()
+	})
+	a.mux.Lock()
+	deliverAt := time.Now().Add(delay)
+	if deliverAt.Before(a.lastAt) {
+		deliverAt = a.lastAt
+	}
+	a.lastAt = deliverAt
+	a.mux.Unlock()
+	select {
+	case a.out <- pipeMessage{data: data, deliverAt: deliverAt}:
+		return nil
+	case <-a.pipe.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (a *PipeMessageAdapter) deliver(data []byte) error {
+	select {
+	case a.peer.in <- data:
+		return nil
+	case <-a.pipe.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (a *PipeMessageAdapter) deliverLoop() {
+	for {
+		select {
+		case msg := <-a.out:
+			select {
+			case <-time.After(time.Until(msg.deliverAt)):
+			case <-a.pipe.closed:
+				return
+			}
+			if a.deliver(msg.data) != nil {
+				return
+			}
+		case <-a.pipe.closed:
+			return
+		}
+	}
+}
+
+// Close closes both ends of the pipe.
+func (a *PipeMessageAdapter) Close() error {
+	a.pipe.closeOnce.Do(func() {
+		close(a.pipe.closed)
+	})
+	return nil
+}
@@ -0,0 +1,136 @@
+package wsrpc
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// processCloseTimeout is the time to wait for the process to exit after its stdin is closed
+const processCloseTimeout = 5 * time.Second
+
+type stdio struct {
+	io.Reader
+	io.WriteCloser
+	in io.Closer
+}
+
+func (s stdio) Close() error {
+	err := s.WriteCloser.Close()
+	if inErr := s.in.Close(); err == nil {
+		err = inErr
+	}
+	return err
+}
+
+// NewStdioMessageAdapter creates an adapter over os.Stdin and os.Stdout with Content-Length framing,
+// eg. to implement a language server or a plugin driven by a parent process.
+func NewStdioMessageAdapter() *StreamMessageAdapter {
+	return NewStreamMessageAdapter(stdio{Reader: os.Stdin, WriteCloser: os.Stdout, in: os.Stdin}, FramingContentLength)
+}
+
+// ProcessMessageAdapter is an adapter to talk to a child process over its stdin and stdout
+// with Content-Length framing, eg. to drive a language server.
+// When the process exits, ReadMessage fails with the exit error (eg. *exec.ExitError, or io.EOF for a clean exit),
+// so the RPC connection is closed.
+type ProcessMessageAdapter struct {
+	*StreamMessageAdapter
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	stdout    *io.PipeReader
+	exited    chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+// NewProcessMessageAdapter starts cmd and creates an adapter to talk to it.
+// The stdin and stdout of cmd must not be set, each line of its stderr is forwarded to logger
+// (discarded if logger is nil) unless cmd.Stderr is set.
+func NewProcessMessageAdapter(cmd *exec.Cmd, logger *log.Logger) (*ProcessMessageAdapter, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutReader, stdoutWriter := io.Pipe()
+	cmd.Stdout = stdoutWriter
+	var stderr *lineLogger
+	if cmd.Stderr == nil && logger != nil {
+		stderr = &lineLogger{logger: logger}
+		cmd.Stderr = stderr
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	a := &ProcessMessageAdapter{
+		StreamMessageAdapter: NewStreamMessageAdapter(stdio{Reader: stdoutReader, WriteCloser: stdin, in: stdoutReader}, FramingContentLength),
+		cmd:                  cmd,
+		stdin:                stdin,
+		stdout:               stdoutReader,
+		exited:               make(chan struct{})}
+	go func() {
+		a.err = cmd.Wait()
+		if stderr != nil {
+			stderr.flush()
+		}
+		// Readers get the exit error, or io.EOF if the process exits successfully
+		_ = stdoutWriter.CloseWithError(a.err)
+		close(a.exited)
+	}()
+	return a, nil
+}
+
+// Wait waits for the process to exit and returns the exit error.
+func (a *ProcessMessageAdapter) Wait() error {
+	<-a.exited
+	return a.err
+}
+
+// Close closes the stdin and stdout of the process, and kills it if it does not exit in time.
+func (a *ProcessMessageAdapter) Close() error {
+	a.closeOnce.Do(func() {
+		_ = a.stdin.Close()
+		_ = a.stdout.Close()
+		select {
+		case <-a.exited:
+		case <-time.After(processCloseTimeout):
+			_ = a.cmd.Process.Kill()
+			<-a.exited
+		}
+	})
+	return nil
+}
+
+// lineLogger is an io.Writer which logs each line written to it
+type lineLogger struct {
+	logger *log.Logger
+	mux    sync.Mutex
+	buf    []byte
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.logger.Println(string(bytes.TrimRight(l.buf[:i], "\r")))
+		l.buf = l.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (l *lineLogger) flush() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if len(l.buf) > 0 {
+		l.logger.Println(string(l.buf))
+		l.buf = nil
+	}
+}
@@ -0,0 +1,147 @@
+package wsrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// RPCPrincipal represents the authenticated identity of a connection.
+type RPCPrincipal interface {
+	// Name returns the name of the principal, eg. the user name
+	Name() string
+	// HasPermission reports whether the principal is granted permission
+	HasPermission(permission string) bool
+}
+
+// HandshakeAuthenticator authenticates a connection with the HTTP upgrade request (headers, cookies, etc.).
+// It returns a nil principal for an anonymous connection, or an error to reject the connection.
+type HandshakeAuthenticator func(r *http.Request) (RPCPrincipal, error)
+
+// LoginAuthenticator authenticates a connection with the params of a login method.
+type LoginAuthenticator func(ctx context.Context, rpcConn *WebsocketRPCConn, params json.RawMessage) (RPCPrincipal, error)
+
+type permissionRule struct {
+	pattern    string
+	permission string
+}
+
+type basicPrincipal struct {
+	name        string
+	permissions map[string]struct{}
+}
+
+// NewRPCPrincipal creates a principal which is granted the specified permissions.
+func NewRPCPrincipal(name string, permissions ...string) RPCPrincipal {
+	p := &basicPrincipal{name: name, permissions: make(map[string]struct{}, len(permissions))}
+	for _, permission := range permissions {
+		p.permissions[permission] = struct{}{}
+	}
+	return p
+}
+
+func (p *basicPrincipal) Name() string {
+	return p.name
+}
+
+func (p *basicPrincipal) HasPermission(permission string) bool {
+	_, ok := p.permissions[permission]
+	return ok
+}
+
+// WithPrincipal sets the principal of the connection, eg. the one returned by AuthenticateRequest.
+func WithPrincipal(principal RPCPrincipal) ConnectOption {
+	return func(rpcConn *WebsocketRPCConn) {
+		rpcConn.principal = principal
+	}
+}
+
+// Principal returns the principal of the connection, nil if it is not authenticated.
+func (rpcConn *WebsocketRPCConn) Principal() RPCPrincipal {
+	rpcConn.authMux.RLock()
+	defer rpcConn.authMux.RUnlock()
+	return rpcConn.principal
+}
+
+// SetPrincipal sets the principal of the connection, nil means logging out.
+func (rpcConn *WebsocketRPCConn) SetPrincipal(principal RPCPrincipal) {
+	rpcConn.authMux.Lock()
+	defer rpcConn.authMux.Unlock()
+	rpcConn.principal = principal
+}
+
+// AuthenticateRequest runs the HandshakeAuthenticator with the HTTP upgrade request.
+// Call it before upgrading the connection, and pass the principal to Connect via WithPrincipal.
+// It returns a nil principal and no error if no HandshakeAuthenticator is set.
+func (rpc *WebsocketRPC) AuthenticateRequest(r *http.Request) (RPCPrincipal, error) {
+	if rpc.HandshakeAuthenticator == nil {
+		return nil, nil
+	}
+	return rpc.HandshakeAuthenticator(r)
+}
+
+// RegisterLogin registers a method which authenticates the connection via authenticator,
+// the result of the method is the name of the principal.
+// An RPCUnauthorizedError is returned to the caller if authenticator fails with an error which is not an RPCErrorInfo.
+// Login methods are not restricted by RequireAuthentication and RequirePermission.
+func (rpc *WebsocketRPC) RegisterLogin(name string, authenticator LoginAuthenticator) {
+	if authenticator == nil {
+		return
+	}
+	rpc.loginMethod[name] = struct{}{}
+	rpc.RegisterLowLevelContext(name, func(ctx context.Context, rpcConn *WebsocketRPCConn, arg json.RawMessage, reply *json.RawMessage) error {
+		principal, err := authenticator(ctx, rpcConn, arg)
+		if err != nil {
+			if rpcError, ok := err.(RPCErrorInfo); ok {
+				return rpcError
+			}
+			return RPCUnauthorizedError
+		}
+		if principal == nil {
+			return RPCUnauthorizedError
+		}
+		rpcConn.SetPrincipal(principal)
+		*reply, err = json.Marshal(principal.Name())
+		return err
+	})
+}
+
+// RequireAuthentication requires the connection to be authenticated before calling the methods
+// whose name matches pattern (same syntax as UseFor, eg. `*` for all methods),
+// otherwise an RPCUnauthorizedError is returned.
+// The rules are checked before any middleware, so that middlewares cannot bypass them.
+// It should be called before serving any connection.
+func (rpc *WebsocketRPC) RequireAuthentication(pattern string) error {
+	return rpc.RequirePermission(pattern, "")
+}
+
+// RequirePermission is like RequireAuthentication but the principal must also have permission,
+// otherwise an RPCForbiddenError is returned. An empty permission only requires authentication.
+func (rpc *WebsocketRPC) RequirePermission(pattern string, permission string) error {
+	if pattern == "" {
+		return errors.New("empty pattern")
+	}
+	rpc.permissions = append(rpc.permissions, permissionRule{pattern: pattern, permission: permission})
+	return nil
+}
+
+// authorize checks the rules of RequirePermission for a call to method
+func (rpcConn *WebsocketRPCConn) authorize(method string) *RPCErrorInfo {
+	if _, ok := rpcConn.RPC.loginMethod[method]; ok {
+		return nil
+	}
+	for _, rule := range rpcConn.RPC.permissions {
+		if !matchMethod(rule.pattern, method) {
+			continue
+		}
+		principal := rpcConn.Principal()
+		if principal == nil {
+			return &RPCUnauthorizedError
+		}
+		if rule.permission != "" && !principal.HasPermission(rule.permission) {
+			return &RPCForbiddenError
+		}
+	}
+	return nil
+}
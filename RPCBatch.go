@@ -0,0 +1,333 @@
+package wsrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// RPCBatch is used to send several calls and notifications in one message.
+// Interceptors are applied to each request in a batch,
+// and the requests which reach the end of the interceptor chain are sent together.
+// An interceptor must not wait for other requests (eg. serialize the calls with a lock),
+// otherwise the batch fails when ctx is done or Timeout elapses.
+type RPCBatch struct {
+	rpcConn *WebsocketRPCConn
+	entries []*RPCBatchCall
+	err     error
+	sent    bool
+}
+
+// RPCBatchCall represents a call or a notification in a batch.
+// Result and Error are available after the batch is sent.
+type RPCBatchCall struct {
+	// Method is the name of the remote method
+	Method string
+	// Params is the raw params
+	Params json.RawMessage
+	// Notification is true if no response is expected
+	Notification bool
+	// Result is the raw result of the call
+	Result json.RawMessage
+	// Error is the error of the call
+	Error   error
+	seq     uint64
+	id      json.RawMessage
+	pending *pendingCall
+	decode  func(result json.RawMessage) error
+}
+
+// NewBatch creates a batch bound to the connection.
+func (rpcConn *WebsocketRPCConn) NewBatch() *RPCBatch {
+	return &RPCBatch{rpcConn: rpcConn}
+}
+
+func (b *RPCBatch) add(entry *RPCBatchCall, err error) *RPCBatchCall {
+	if err != nil {
+		entry.Error = err
+		if b.err == nil {
+			b.err = err
+		}
+	}
+	b.entries = append(b.entries, entry)
+	return entry
+}
+
+// CallLowLevel adds a call in low-level way (use json.RawMessage).
+func (b *RPCBatch) CallLowLevel(name string, params json.RawMessage) *RPCBatchCall {
+	return b.add(&RPCBatchCall{Method: name, Params: params}, nil)
+}
+
+// CallExplicitly adds a call in a `net/rpc`-like way.
+// reply is filled when the batch is sent.
+func (b *RPCBatch) CallExplicitly(name string, params interface{}, reply interface{}) *RPCBatchCall {
+	paramBytes, err := json.Marshal(params)
+	return b.add(&RPCBatchCall{
+		Method: name,
+		Params: paramBytes,
+		decode: func(result json.RawMessage) error {
+			return json.Unmarshal(result, reply)
+		}}, err)
+}
+
+// Call adds a call whose params are encoded from args via inCodec,
+// and whose result is decoded via outCodec to replies (must be pointers) when the batch is sent.
+func (b *RPCBatch) Call(name string, inCodec RPCParamsCodec, outCodec RPCParamsCodec, args []interface{}, replies ...interface{}) *RPCBatchCall {
+	params, err := encodeArgs(inCodec, args)
+	return b.add(&RPCBatchCall{
+		Method: name,
+		Params: params,
+		decode: func(result json.RawMessage) error {
+			return decodeReplies(outCodec, result, replies)
+		}}, err)
+}
+
+// NotifyLowLevel adds a notification in low-level way (use json.RawMessage).
+func (b *RPCBatch) NotifyLowLevel(name string, params json.RawMessage) *RPCBatchCall {
+	return b.add(&RPCBatchCall{Method: name, Params: params, Notification: true}, nil)
+}
+
+// NotifyExplicitly adds a notification in a `net/rpc`-like way.
+func (b *RPCBatch) NotifyExplicitly(name string, params interface{}) *RPCBatchCall {
+	paramBytes, err := json.Marshal(params)
+	return b.add(&RPCBatchCall{Method: name, Params: paramBytes, Notification: true}, err)
+}
+
+// Notify adds a notification whose params are encoded from args via inCodec.
+func (b *RPCBatch) Notify(name string, inCodec RPCParamsCodec, args ...interface{}) *RPCBatchCall {
+	params, err := encodeArgs(inCodec, args)
+	return b.add(&RPCBatchCall{Method: name, Params: params, Notification: true}, err)
+}
+
+// Send sends the batch and waits for all the responses.
+// The returned error is about the whole batch, while the error of each call is stored in RPCBatchCall.
+func (b *RPCBatch) Send() error {
+	return b.SendContext(context.Background())
+}
+
+// SendContext is like Send but the batch is aborted when ctx is done.
+// Timeout of the connection is applied to the whole batch.
+// If the peer rejects the whole batch (eg. it exceeds MaxBatchSize), the error of the peer is returned.
+func (b *RPCBatch) SendContext(ctx context.Context) error {
+	if b.sent {
+		return errors.New("the batch has been sent")
+	}
+	if b.err != nil {
+		return b.err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.sent = true
+	if len(b.entries) == 0 {
+		return nil
+	}
+	var err error
+	if len(b.rpcConn.interceptor) == 0 && len(b.rpcConn.RPC.interceptor) == 0 {
+		err = b.send(ctx, b.entries)
+	} else {
+		err = b.sendIntercepted(ctx)
+	}
+	for _, entry := range b.entries {
+		if entry.Error == nil && entry.Result != nil && entry.decode != nil {
+			entry.Error = entry.decode(entry.Result)
+		}
+	}
+	return err
+}
+
+// sendIntercepted passes each entry through the interceptors,
+// and sends the entries which reach the invoker in one message
+func (b *RPCBatch) sendIntercepted(ctx context.Context) error {
+	rpcConn := b.rpcConn
+	// Index of an entry which reaches the invoker, or -1 for one returned by the interceptors without invoking
+	arrived := make(chan int, len(b.entries))
+	released := make(chan struct{})
+	results := make([]json.RawMessage, len(b.entries))
+	errs := make([]error, len(b.entries))
+	reached := make([]bool, len(b.entries))
+	// Entries reaching the invoker after collecting is stopped are not sent
+	collecting := true
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	for i, entry := range b.entries {
+		i, entry := i, entry
+		var once sync.Once
+		invoker := rpcConn.applyInterceptors(func(req *RPCOutgoingRequest, reply *json.RawMessage) error {
+			once.Do(func() {
+				mux.Lock()
+				if collecting {
+					entry.Method, entry.Params = req.Method, req.Params
+					reached[i] = true
+				}
+				mux.Unlock()
+				arrived <- i
+			})
+			<-released
+			if reply != nil {
+				*reply = entry.Result
+			}
+			return entry.Error
+		})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply *json.RawMessage
+			if !entry.Notification {
+				reply = &results[i]
+			}
+			errs[i] = invoker(&RPCOutgoingRequest{
+				Context:      ctx,
+				Conn:         rpcConn,
+				Method:       entry.Method,
+				Params:       entry.Params,
+				Notification: entry.Notification}, reply)
+			once.Do(func() {
+				arrived <- -1
+			})
+		}()
+	}
+	// An interceptor may hold the other entries back, eg. by serializing the calls with a lock,
+	// so the batch fails if the entries do not reach the invoker in time
+	var err error
+	timer := time.NewTimer(rpcConn.Timeout)
+	defer timer.Stop()
+	for n := 0; n < len(b.entries) && err == nil; n++ {
+		select {
+		case <-arrived:
+		case <-timer.C:
+			err = errCallTimeout
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	mux.Lock()
+	collecting = false
+	mux.Unlock()
+	// Keep the entries in the order they are added
+	var entries []*RPCBatchCall
+	for i, entry := range b.entries {
+		if err != nil {
+			entry.Error = err
+		} else if reached[i] {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) != 0 {
+		err = b.send(ctx, entries)
+	}
+	close(released)
+	wg.Wait()
+	for i, entry := range b.entries {
+		entry.Result, entry.Error = results[i], errs[i]
+	}
+	return err
+}
+
+// send sends the entries in one message and waits for the responses,
+// the raw result or the error of each call is stored in the entry
+func (b *RPCBatch) send(ctx context.Context, entries []*RPCBatchCall) error {
+	rpcConn := b.rpcConn
+	msgs := make([]rpcMessage, len(entries))
+	var calls []*RPCBatchCall
+	fail := func(calls []*RPCBatchCall, err error) error {
+		for _, call := range calls {
+			rpcConn.pending.Delete(call.seq)
+			call.Error = err
+		}
+		return err
+	}
+	for i, entry := range entries {
+		method := entry.Method
+		msgs[i] = rpcMessage{
+			JSONRPC: "2.0",
+			Method:  &method,
+			Params:  entry.Params}
+		if !entry.Notification {
+			var err error
+			entry.pending = newPendingCall()
+			entry.seq, entry.id, err = rpcConn.allocRequestSeq(entry.pending)
+			if err != nil {
+				return fail(append(calls, entry), err)
+			}
+			msgs[i].ID = entry.id
+			calls = append(calls, entry)
+		}
+	}
+	resultBytes, err := json.Marshal(msgs)
+	if err != nil {
+		return fail(calls, err)
+	}
+	// The peer responds with an error without ID if it rejects the whole batch
+	rejected := make(chan *RPCErrorInfo, 1)
+	if len(calls) != 0 {
+		rpcConn.batches.Store(rejected, struct{}{})
+		defer rpcConn.batches.Delete(rejected)
+	}
+	err = rpcConn.adapter.WriteMessage(resultBytes)
+	if err != nil {
+		return fail(calls, err)
+	}
+	timer := time.NewTimer(rpcConn.Timeout)
+	defer timer.Stop()
+	for i, call := range calls {
+		var r *rpcMessage
+		select {
+		case <-call.pending.done:
+			r = call.pending.msg
+			err = call.pending.err
+		case rpcErr := <-rejected:
+			return fail(calls[i:], rpcErr)
+		case <-timer.C:
+			err = errCallTimeout
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err == ErrConnectionClosed {
+			return fail(calls[i:], err)
+		}
+		if err != nil {
+			for _, c := range calls[i:] {
+				rpcConn.sendCancelRequest(c.id)
+			}
+			return fail(calls[i:], err)
+		}
+		if r.Error != nil {
+			call.Error = r.Error
+			continue
+		}
+		call.Result = r.Result
+	}
+	return nil
+}
+
+func encodeArgs(inCodec RPCParamsCodec, args []interface{}) (json.RawMessage, error) {
+	values := make([]reflect.Value, len(args))
+	for i := range args {
+		// Keep nil as a valid value of interface type
+		values[i] = reflect.ValueOf(&args[i]).Elem()
+	}
+	return inCodec.Encode(values)
+}
+
+func decodeReplies(outCodec RPCParamsCodec, result json.RawMessage, replies []interface{}) error {
+	types := make([]reflect.Type, len(replies))
+	for i, reply := range replies {
+		t := reflect.TypeOf(reply)
+		if t == nil || t.Kind() != reflect.Ptr {
+			return errors.New("reply argument must be a pointer")
+		}
+		types[i] = t.Elem()
+	}
+	values, err := outCodec.Decode(result, types)
+	if err != nil {
+		return err
+	}
+	for i, value := range values {
+		reflect.ValueOf(replies[i]).Elem().Set(value)
+	}
+	return nil
+}
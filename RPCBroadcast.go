@@ -0,0 +1,106 @@
+package wsrpc
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+func (rpc *WebsocketRPC) trackConn(rpcConn *WebsocketRPCConn) {
+	if !rpc.TrackConnections {
+		return
+	}
+	rpc.connsMux.Lock()
+	rpc.conns[rpcConn] = struct{}{}
+	rpc.connsMux.Unlock()
+}
+
+func (rpc *WebsocketRPC) untrackConn(rpcConn *WebsocketRPCConn) {
+	rpc.connsMux.Lock()
+	delete(rpc.conns, rpcConn)
+	rpc.connsMux.Unlock()
+}
+
+// ConnectionCount returns the number of live connections (TrackConnections must be enabled).
+func (rpc *WebsocketRPC) ConnectionCount() int {
+	rpc.connsMux.RLock()
+	defer rpc.connsMux.RUnlock()
+	return len(rpc.conns)
+}
+
+// Connections returns a snapshot of live connections (TrackConnections must be enabled).
+func (rpc *WebsocketRPC) Connections() []*WebsocketRPCConn {
+	rpc.connsMux.RLock()
+	defer rpc.connsMux.RUnlock()
+	r := make([]*WebsocketRPCConn, 0, len(rpc.conns))
+	for rpcConn := range rpc.conns {
+		r = append(r, rpcConn)
+	}
+	return r
+}
+
+// RangeConnections calls f for each live connection until f returns false (TrackConnections must be enabled).
+func (rpc *WebsocketRPC) RangeConnections(f func(rpcConn *WebsocketRPCConn) bool) {
+	for _, rpcConn := range rpc.Connections() {
+		if !f(rpcConn) {
+			break
+		}
+	}
+}
+
+// Broadcast sends a notification to all live connections (TrackConnections must be enabled).
+// See BroadcastLowLevel for details.
+func (rpc *WebsocketRPC) Broadcast(name string, params interface{}) (map[*WebsocketRPCConn]error, error) {
+	return rpc.BroadcastFilter(name, params, nil)
+}
+
+// BroadcastFilter sends a notification to the live connections for which filter returns true,
+// eg. by checking the Session. See BroadcastLowLevel for details.
+func (rpc *WebsocketRPC) BroadcastFilter(name string, params interface{}, filter func(rpcConn *WebsocketRPCConn) bool) (map[*WebsocketRPCConn]error, error) {
+	paramBytes, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.BroadcastLowLevel(name, paramBytes, filter), nil
+}
+
+// BroadcastLowLevel sends a notification in low-level way (use json.RawMessage) to the live connections
+// for which filter returns true (nil filter means all).
+//
+// The message is encoded once and written to the connections concurrently, interceptors are not applied.
+// The returned map contains the connections which failed to receive the message, nil if all succeeded.
+func (rpc *WebsocketRPC) BroadcastLowLevel(name string, params json.RawMessage, filter func(rpcConn *WebsocketRPCConn) bool) map[*WebsocketRPCConn]error {
+	msg := rpcMessage{
+		JSONRPC: "2.0",
+		Method:  &name,
+		Params:  params}
+	resultBytes, err := json.Marshal(msg)
+	var failed map[*WebsocketRPCConn]error
+	var failedMux sync.Mutex
+	var wg sync.WaitGroup
+	for _, rpcConn := range rpc.Connections() {
+		if filter != nil && !filter(rpcConn) {
+			continue
+		}
+		if err != nil {
+			if failed == nil {
+				failed = make(map[*WebsocketRPCConn]error)
+			}
+			failed[rpcConn] = err
+			continue
+		}
+		wg.Add(1)
+		go func(rpcConn *WebsocketRPCConn) {
+			defer wg.Done()
+			if err := rpcConn.adapter.WriteMessage(resultBytes); err != nil {
+				failedMux.Lock()
+				if failed == nil {
+					failed = make(map[*WebsocketRPCConn]error)
+				}
+				failed[rpcConn] = err
+				failedMux.Unlock()
+			}
+		}(rpcConn)
+	}
+	wg.Wait()
+	return failed
+}
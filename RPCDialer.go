@@ -0,0 +1,262 @@
+package wsrpc
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrConnectionLost is returned by calls when the connection of a dialed client is lost.
+// A call which fails with it may or may not have been processed by the peer.
+var ErrConnectionLost = errors.New("connection lost")
+
+// DialOptions is used to customize Dial.
+type DialOptions struct {
+	//Dialer is used to dial the websocket connection, default is websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+	//Header is sent with the handshake request.
+	Header http.Header
+	//ConnectOptions are applied to the created connection.
+	ConnectOptions []ConnectOption
+	//MinBackoff is the delay before the first reconnection attempt, default is 500 milliseconds.
+	//The delay doubles after each failed attempt with a random jitter.
+	MinBackoff time.Duration
+	//MaxBackoff limits the delay between reconnection attempts, default is 30 seconds.
+	MaxBackoff time.Duration
+	//MaxRetries limits the number of consecutive failed reconnection attempts, 0 means unlimited.
+	//The connection is closed when the limit is reached.
+	MaxRetries int
+	//OnReconnect is called in a new goroutine after the connection is re-established,
+	//eg. to login and resubscribe. Subscriptions are ended when the connection is lost.
+	//The calls queued by QueueWhileDisconnected are sent after it returns, while its own calls are sent directly.
+	OnReconnect func(rpcConn *WebsocketRPCConn)
+	//QueueWhileDisconnected makes calls and notifications made while disconnected
+	//wait for the reconnection (within their timeout) instead of failing with ErrConnectionLost.
+	QueueWhileDisconnected bool
+	//IsIdempotent reports whether a method can be safely called again.
+	//Calls of such methods are retried if the connection is lost before their responses arrive.
+	IsIdempotent func(method string) bool
+	//PingInterval enables the websocket ping/pong keepalive, see WebsocketMessageAdapter.SetKeepalive.
+	//The connection is re-dialed if the peer stops responding.
+	PingInterval time.Duration
+	//PongTimeout is the time to wait for a pong after PingInterval, default is 10 seconds.
+	PongTimeout time.Duration
+}
+
+// reconnectingAdapter is a MessageAdapter which re-dials the websocket connection when it is lost
+type reconnectingAdapter struct {
+	url       string
+	options   DialOptions
+	rpcConn   *WebsocketRPCConn
+	mux       sync.Mutex
+	writeMux  sync.Mutex
+	conn      *websocket.Conn
+	stop      chan struct{}
+	connected chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Dial dials url and returns a connection which is served in a new goroutine.
+// When the connection is lost, it is re-dialed automatically with exponential backoff,
+// and the connection object (with its handlers, session, etc.) stays the same.
+// opts can be nil to use the default options.
+func (rpc *WebsocketRPC) Dial(url string, opts *DialOptions) (*WebsocketRPCConn, error) {
+	a := &reconnectingAdapter{
+		url:       url,
+		connected: make(chan struct{}),
+		closed:    make(chan struct{})}
+	if opts != nil {
+		a.options = *opts
+	}
+	if a.options.Dialer == nil {
+		a.options.Dialer = websocket.DefaultDialer
+	}
+	if a.options.MinBackoff <= 0 {
+		a.options.MinBackoff = 500 * time.Millisecond
+	}
+	if a.options.MaxBackoff <= 0 {
+		a.options.MaxBackoff = 30 * time.Second
+	}
+	if a.options.PongTimeout <= 0 {
+		a.options.PongTimeout = 10 * time.Second
+	}
+	conn, _, err := a.options.Dialer.Dial(url, a.options.Header)
+	if err != nil {
+		return nil, err
+	}
+	a.setConn(conn)
+	close(a.connected)
+	rpcConn := rpc.ConnectAdapter(a, a.options.ConnectOptions...)
+	rpcConn.reconnector = a
+	a.rpcConn = rpcConn
+	go rpcConn.ServeConn()
+	return rpcConn, nil
+}
+
+// ReadMessage reads a message, it re-dials the connection if it is lost.
+func (a *reconnectingAdapter) ReadMessage() ([]byte, error) {
+	for {
+		conn, err := a.connect()
+		if err != nil {
+			return nil, err
+		}
+		_, message, err := conn.ReadMessage()
+		if err == nil {
+			if a.options.PingInterval > 0 {
+				_ = conn.SetReadDeadline(time.Now().Add(a.options.PingInterval + a.options.PongTimeout))
+			}
+			return message, nil
+		}
+		a.lost(conn)
+	}
+}
+
+// WriteMessage writes a message, it returns ErrConnectionLost if disconnected.
+func (a *reconnectingAdapter) WriteMessage(data []byte) error {
+	a.writeMux.Lock()
+	defer a.writeMux.Unlock()
+	a.mux.Lock()
+	conn := a.conn
+	a.mux.Unlock()
+	if conn == nil {
+		select {
+		case <-a.closed:
+			return ErrConnectionClosed
+		default:
+			return ErrConnectionLost
+		}
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		a.lost(conn)
+		return ErrConnectionLost
+	}
+	return nil
+}
+
+// Close closes the connection and stops reconnecting.
+func (a *reconnectingAdapter) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.closed)
+	})
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.conn != nil {
+		if a.stop != nil {
+			close(a.stop)
+			a.stop = nil
+		}
+		return a.conn.Close()
+	}
+	return nil
+}
+
+// setConn makes conn the current connection, the caller must hold the lock unless it is the first one
+func (a *reconnectingAdapter) setConn(conn *websocket.Conn) {
+	a.conn = conn
+	if a.options.PingInterval > 0 {
+		a.stop = make(chan struct{})
+		startKeepalive(conn, a.options.PingInterval, a.options.PongTimeout, a.stop)
+	}
+}
+
+// connect returns the current connection, or dials a new one with backoff
+func (a *reconnectingAdapter) connect() (*websocket.Conn, error) {
+	a.mux.Lock()
+	conn := a.conn
+	a.mux.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	backoff := a.options.MinBackoff
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-a.closed:
+			return nil, ErrConnectionClosed
+		case <-time.After(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))):
+		}
+		conn, _, err := a.options.Dialer.Dial(a.url, a.options.Header)
+		if err == nil {
+			a.mux.Lock()
+			select {
+			case <-a.closed:
+				a.mux.Unlock()
+				_ = conn.Close()
+				return nil, ErrConnectionClosed
+			default:
+			}
+			a.setConn(conn)
+			connected := a.connected
+			a.mux.Unlock()
+			// Release the queued calls after OnReconnect, eg. so that they are sent after logging in again
+			go func() {
+				if a.options.OnReconnect != nil {
+					a.options.OnReconnect(a.rpcConn)
+				}
+				close(connected)
+			}()
+			return conn, nil
+		}
+		if a.options.MaxRetries > 0 && attempt >= a.options.MaxRetries {
+			return nil, err
+		}
+		backoff *= 2
+		if backoff > a.options.MaxBackoff {
+			backoff = a.options.MaxBackoff
+		}
+	}
+}
+
+// lost marks conn as lost and fails the calls waiting for responses on it
+func (a *reconnectingAdapter) lost(conn *websocket.Conn) {
+	a.mux.Lock()
+	if a.conn != conn {
+		a.mux.Unlock()
+		return
+	}
+	a.conn = nil
+	a.connected = make(chan struct{})
+	if a.stop != nil {
+		close(a.stop)
+		a.stop = nil
+	}
+	a.mux.Unlock()
+	_ = conn.Close()
+	a.rpcConn.failPending(ErrConnectionLost)
+	a.rpcConn.closeSubscriptions()
+}
+
+// retryable reports whether a call (or notification) which fails with err should be retried after reconnection
+func (rpcConn *WebsocketRPCConn) retryable(name string, err error, sent bool) bool {
+	a := rpcConn.reconnector
+	if a == nil || err != ErrConnectionLost {
+		return false
+	}
+	if !sent {
+		return a.options.QueueWhileDisconnected
+	}
+	return a.options.IsIdempotent != nil && a.options.IsIdempotent(name)
+}
+
+// waitReconnect waits for the connection to be re-established
+func (rpcConn *WebsocketRPCConn) waitReconnect(ctx context.Context, timeout <-chan time.Time) error {
+	a := rpcConn.reconnector
+	a.mux.Lock()
+	connected := a.connected
+	a.mux.Unlock()
+	select {
+	case <-connected:
+		return nil
+	case <-rpcConn.done:
+		return ErrConnectionClosed
+	case <-timeout:
+		return errCallTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -33,6 +33,26 @@ var RPCParseError = RPCErrorInfo{
 	Code:    -32700,
 	Message: "Parse error"}
 
+// RPCServerBusyError represents that the request is rejected because too many messages are being processed.
+var RPCServerBusyError = RPCErrorInfo{
+	Code:    -32001,
+	Message: "Server busy"}
+
+// RPCShuttingDownError represents that the request is rejected because the connection is shutting down.
+var RPCShuttingDownError = RPCErrorInfo{
+	Code:    -32002,
+	Message: "Shutting down"}
+
+// RPCUnauthorizedError represents that the request is rejected because the connection is not authenticated.
+var RPCUnauthorizedError = RPCErrorInfo{
+	Code:    -32003,
+	Message: "Unauthorized"}
+
+// RPCForbiddenError represents that the request is rejected because the principal lacks the required permission.
+var RPCForbiddenError = RPCErrorInfo{
+	Code:    -32004,
+	Message: "Forbidden"}
+
 func (err RPCErrorInfo) Error() string {
 	return err.Message
 }
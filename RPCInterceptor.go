@@ -0,0 +1,67 @@
+package wsrpc
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// RPCOutgoingRequest describes an outgoing call or notification passed through interceptors.
+type RPCOutgoingRequest struct {
+	// Context controls the lifetime of the call
+	Context context.Context
+	// Conn is the RPC connection which the request is sent to
+	Conn *WebsocketRPCConn
+	// Method is the name of the remote method
+	Method string
+	// Params is the raw params, can be modified by interceptors
+	Params json.RawMessage
+	// Notification is true if no response is expected
+	Notification bool
+}
+
+// RPCInvoker sends an outgoing request and writes the result to reply.
+// For a notification, reply is nil.
+type RPCInvoker func(req *RPCOutgoingRequest, reply *json.RawMessage) error
+
+// RPCInterceptor wraps an RPCInvoker to run code before and after the request is sent.
+type RPCInterceptor func(next RPCInvoker) RPCInvoker
+
+// Intercept adds interceptors which are applied to outgoing calls and notifications of all connections.
+// Interceptors added earlier wrap those added later.
+// It should be called before making any call.
+func (rpc *WebsocketRPC) Intercept(interceptor ...RPCInterceptor) {
+	rpc.interceptor = appendInterceptors(rpc.interceptor, interceptor)
+}
+
+// Intercept adds interceptors which are applied to outgoing calls and notifications of this connection.
+// They are wrapped by the interceptors of the RPC service.
+// It should be called before making any call.
+func (rpcConn *WebsocketRPCConn) Intercept(interceptor ...RPCInterceptor) {
+	rpcConn.interceptor = appendInterceptors(rpcConn.interceptor, interceptor)
+}
+
+func appendInterceptors(list []RPCInterceptor, interceptor []RPCInterceptor) []RPCInterceptor {
+	for _, i := range interceptor {
+		if i != nil {
+			list = append(list, i)
+		}
+	}
+	return list
+}
+
+func (rpcConn *WebsocketRPCConn) invoke(req *RPCOutgoingRequest, reply *json.RawMessage) error {
+	if req.Notification {
+		return rpcConn.notifyContext(req.Context, req.Method, req.Params)
+	}
+	return rpcConn.callLowLevel(req.Context, req.Method, req.Params, reply)
+}
+
+func (rpcConn *WebsocketRPCConn) applyInterceptors(invoker RPCInvoker) RPCInvoker {
+	for i := len(rpcConn.interceptor) - 1; i >= 0; i-- {
+		invoker = rpcConn.interceptor[i](invoker)
+	}
+	for i := len(rpcConn.RPC.interceptor) - 1; i >= 0; i-- {
+		invoker = rpcConn.RPC.interceptor[i](invoker)
+	}
+	return invoker
+}
@@ -0,0 +1,91 @@
+package wsrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrHeartbeatTimeout is reported by Err when the connection is closed because the peer stops responding.
+var ErrHeartbeatTimeout = errors.New("heartbeat timeout")
+
+// PingMethod is the name of the built-in method used by StartHeartbeat, its result is `"pong"`.
+const PingMethod = "rpc.ping"
+
+// EnablePing registers the built-in method PingMethod.
+func (rpc *WebsocketRPC) EnablePing() {
+	rpc.RegisterLowLevelContext(PingMethod, func(_ context.Context, _ *WebsocketRPCConn, _ json.RawMessage, reply *json.RawMessage) error {
+		*reply = json.RawMessage(`"pong"`)
+		return nil
+	})
+}
+
+// isPing reports whether the requests are all calls to PingMethod
+func isPing(requests []rpcMessage) bool {
+	for _, msg := range requests {
+		if msg.Method == nil || *msg.Method != PingMethod {
+			return false
+		}
+	}
+	return true
+}
+
+// StartHeartbeat calls PingMethod on the peer every interval in a new goroutine,
+// and closes the connection with ErrHeartbeatTimeout if no response is received within timeout.
+// Any response (even an error) means the peer is alive, so it works with peers that do not enable ping.
+// It is an application-level alternative to WebsocketMessageAdapter.SetKeepalive for other adapters.
+func (rpcConn *WebsocketRPCConn) StartHeartbeat(interval time.Duration, timeout time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rpcConn.done:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := context.WithTimeout(rpcConn.ctx, timeout)
+			err := rpcConn.callLowLevel(ctx, PingMethod, nil, nil)
+			cancel()
+			if err == context.DeadlineExceeded || err == errCallTimeout {
+				_ = rpcConn.closeWithError(ErrHeartbeatTimeout)
+				return
+			}
+		}
+	}()
+}
+
+// startKeepalive pings the peer every interval until stop is closed,
+// the read deadline of conn is extended when a pong or message is received.
+func startKeepalive(conn *websocket.Conn, interval time.Duration, timeout time.Duration, stop <-chan struct{}) {
+	_ = conn.SetReadDeadline(time.Now().Add(interval + timeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(interval + timeout))
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout)); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// keepaliveError converts the error of an expired read deadline to ErrHeartbeatTimeout
+func keepaliveError(err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ErrHeartbeatTimeout
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package wsrpc
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// RPCRequest describes an incoming request passed through middlewares.
+type RPCRequest struct {
+	// Context is the per-request context
+	Context context.Context
+	// Conn is the RPC connection which the request comes from
+	Conn *WebsocketRPCConn
+	// Method is the name of the method
+	Method string
+	// ID is the request ID, nil for a notification
+	ID json.RawMessage
+	// Params is the raw params, can be modified by middlewares
+	Params json.RawMessage
+}
+
+// RPCHandler handles a request and writes the result to reply.
+type RPCHandler func(req *RPCRequest, reply *json.RawMessage) error
+
+// RPCMiddleware wraps an RPCHandler to run code before and after the next handler.
+// A middleware can return an error (eg. an RPCErrorInfo) without calling next to short-circuit the request.
+type RPCMiddleware func(next RPCHandler) RPCHandler
+
+type rpcMiddlewareEntry struct {
+	pattern    string
+	middleware RPCMiddleware
+}
+
+// Use adds middlewares which are applied to all methods.
+// Middlewares added earlier wrap those added later.
+// It should be called before serving any connection.
+func (rpc *WebsocketRPC) Use(middleware ...RPCMiddleware) {
+	for _, m := range middleware {
+		if m == nil {
+			continue
+		}
+		rpc.middleware = append(rpc.middleware, rpcMiddlewareEntry{middleware: m})
+	}
+}
+
+// UseFor adds middlewares which are applied to the methods whose name matches pattern.
+// In pattern, `*` matches any sequence of characters (including `/` and `.`), and `?` matches any single character.
+// It should be called before serving any connection.
+func (rpc *WebsocketRPC) UseFor(pattern string, middleware ...RPCMiddleware) error {
+	for _, m := range middleware {
+		if m == nil {
+			continue
+		}
+		rpc.middleware = append(rpc.middleware, rpcMiddlewareEntry{pattern: pattern, middleware: m})
+	}
+	return nil
+}
+
+func (rpc *WebsocketRPC) applyMiddleware(name string, handler RPCHandler) RPCHandler {
+	for i := len(rpc.middleware) - 1; i >= 0; i-- {
+		entry := rpc.middleware[i]
+		if entry.pattern != "" && !matchMethod(entry.pattern, name) {
+			continue
+		}
+		handler = entry.middleware(handler)
+	}
+	return handler
+}
+
+// matchMethod reports whether name matches pattern, where `*` matches any sequence of characters
+// and `?` matches any single character.
+func matchMethod(pattern string, name string) bool {
+	p, n := []rune(pattern), []rune(name)
+	i, j := 0, 0
+	// Position of the last `*` in p and where it starts to match in n, for backtracking
+	star, mark := -1, 0
+	for j < len(n) {
+		switch {
+		case i < len(p) && (p[i] == '?' || p[i] == n[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == '*':
+			star, mark = i, j
+			i++
+		case star >= 0:
+			mark++
+			i, j = star+1, mark
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
@@ -0,0 +1,100 @@
+package wsrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+)
+
+// OrderingKeyFunc extracts an ordering key from the params of a request.
+// Requests with the same key are processed in arrival order.
+type OrderingKeyFunc func(params json.RawMessage) string
+
+type orderedQueue struct {
+	tasks []func()
+}
+
+// Order makes the requests and notifications to the method processed in arrival order on each connection.
+//
+// If key is nil, all the requests to the ordered methods with nil key are serialized together.
+// Otherwise, the requests are serialized per key, eg. per document ID extracted from params.
+// Keys are shared by all the ordered methods, so that different methods operating on the same
+// object can be serialized. Other methods are still processed concurrently.
+//
+// A batch is ordered as a whole by the key of its first ordered request.
+// If key panics (eg. on unexpected params), the panic is reported to PanicHandler
+// and the requests are rejected with RPCInvalidParamsError.
+// It should be called before serving any connection.
+func (rpc *WebsocketRPC) Order(name string, key OrderingKeyFunc) {
+	if key == nil {
+		key = func(json.RawMessage) string {
+			return ""
+		}
+	}
+	rpc.ordering[name] = key
+}
+
+// orderingKey returns the key of the queue which the requests should be put in
+func (rpcConn *WebsocketRPCConn) orderingKey(requests []rpcMessage) (string, bool, error) {
+	if rpcConn.Sequential {
+		return "", true, nil
+	}
+	for _, msg := range requests {
+		if msg.Method == nil {
+			continue
+		}
+		if key, ok := rpcConn.RPC.ordering[*msg.Method]; ok {
+			k, err := rpcConn.callOrderingKey(key, msg)
+			return k, true, err
+		}
+	}
+	return "", false, nil
+}
+
+// callOrderingKey runs key in the read loop, a panic is recovered and reported to PanicHandler
+func (rpcConn *WebsocketRPCConn) callOrderingKey(key OrderingKeyFunc, msg rpcMessage) (k string, err error) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		if rpcConn.RPC.PanicHandler != nil {
+			rpcConn.RPC.PanicHandler(&RPCRequest{
+				Context: rpcConn.ctx,
+				Conn:    rpcConn,
+				Method:  *msg.Method,
+				ID:      msg.ID,
+				Params:  msg.Params}, recovered, debug.Stack())
+		}
+		err = fmt.Errorf("ordering key panics: %v", recovered)
+	}()
+	return key(msg.Params), nil
+}
+
+// enqueueOrdered runs the task after all the tasks queued with the same key
+func (rpcConn *WebsocketRPCConn) enqueueOrdered(key string, task func()) {
+	rpcConn.queueMux.Lock()
+	if q, ok := rpcConn.queues[key]; ok {
+		q.tasks = append(q.tasks, task)
+		rpcConn.queueMux.Unlock()
+		return
+	}
+	q := new(orderedQueue)
+	rpcConn.queues[key] = q
+	rpcConn.queueMux.Unlock()
+	go func() {
+		for {
+			task()
+			rpcConn.queueMux.Lock()
+			if len(q.tasks) == 0 {
+				delete(rpcConn.queues, key)
+				rpcConn.queueMux.Unlock()
+				return
+			}
+			task = q.tasks[0]
+			q.tasks[0] = nil
+			q.tasks = q.tasks[1:]
+			rpcConn.queueMux.Unlock()
+		}
+	}()
+}
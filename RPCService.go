@@ -0,0 +1,208 @@
+package wsrpc
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// RPCSkippedMethod describes a method that is not registered by RegisterService.
+type RPCSkippedMethod struct {
+	// Name is the name of the Go method
+	Name string
+	// Reason describes why the method is skipped
+	Reason string
+}
+
+// RegisterServiceOption is used to customize RegisterService.
+type RegisterServiceOption func(*registerServiceOptions)
+
+type registerServiceOptions struct {
+	separator string
+	transform func(string) string
+	inCodec   RPCParamsCodec
+	outCodec  RPCParamsCodec
+}
+
+// WithServiceSeparator sets the separator between the prefix and the method name, default is ".".
+func WithServiceSeparator(separator string) RegisterServiceOption {
+	return func(o *registerServiceOptions) {
+		o.separator = separator
+	}
+}
+
+// WithServiceNameTransform sets a function to transform the Go method name to the RPC method name.
+// See LowerCamelCase and SnakeCase.
+func WithServiceNameTransform(transform func(string) string) RegisterServiceOption {
+	return func(o *registerServiceOptions) {
+		o.transform = transform
+	}
+}
+
+// WithServiceCodecs sets the codecs used by the methods which are registered via Register.
+// Default is RPCPositionalParamsCodec for both params and result.
+func WithServiceCodecs(inCodec RPCParamsCodec, outCodec RPCParamsCodec) RegisterServiceOption {
+	return func(o *registerServiceOptions) {
+		o.inCodec = inCodec
+		o.outCodec = outCodec
+	}
+}
+
+// LowerCamelCase converts the first letter of name to lower case, eg. `GetUser` to `getUser`.
+func LowerCamelCase(name string) string {
+	runes := []rune(name)
+	for i := 0; i < len(runes); i++ {
+		// Keep the last upper letter of an acronym, eg. `HTTPServer` to `httpServer`
+		if !unicode.IsUpper(runes[i]) || (i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			break
+		}
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
+
+// SnakeCase converts name to snake case, eg. `GetHTTPServer` to `get_http_server`.
+func SnakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// RegisterService is used to register all suitable exported methods of rcvr for RPC,
+// just like RegisterName in `net/rpc`.
+//
+// Methods are named `prefix.Method` by default (the separator and the case can be customized via options).
+// A method that matches the rules of RegisterExplicitly is registered via RegisterExplicitly,
+// the others are registered via Register with the codecs specified by WithServiceCodecs.
+// Methods that cannot be registered are skipped and reported in the result.
+func (rpc *WebsocketRPC) RegisterService(prefix string, rcvr interface{}, opts ...RegisterServiceOption) ([]RPCSkippedMethod, error) {
+	if rcvr == nil {
+		return nil, errors.New("nil pointer passed to RegisterService")
+	}
+	options := registerServiceOptions{
+		separator: ".",
+		inCodec:   NewRPCPositionalParamsCodec(),
+		outCodec:  NewRPCPositionalParamsCodec(),
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	rcvrValue := reflect.ValueOf(rcvr)
+	rcvrType := rcvrValue.Type()
+	var skipped []RPCSkippedMethod
+	if rcvrType.Kind() != reflect.Ptr {
+		// Methods with pointer receiver are not in the method set of the value
+		ptrType := reflect.PtrTo(rcvrType)
+		for i := 0; i < ptrType.NumMethod(); i++ {
+			m := ptrType.Method(i)
+			if _, ok := rcvrType.MethodByName(m.Name); !ok {
+				skipped = append(skipped, RPCSkippedMethod{
+					Name:   m.Name,
+					Reason: "method has pointer receiver, pass a pointer to RegisterService"})
+			}
+		}
+	}
+	for i := 0; i < rcvrType.NumMethod(); i++ {
+		m := rcvrType.Method(i)
+		fValue := rcvrValue.Method(i)
+		name := m.Name
+		if options.transform != nil {
+			name = options.transform(name)
+		}
+		if prefix != "" {
+			name = prefix + options.separator + name
+		}
+		var err error
+		explicit := isExplicitMethodType(fValue.Type())
+		if explicit {
+			err = rpc.RegisterExplicitly(name, fValue.Interface())
+		}
+		// Fall back to Register if it only looks like an explicit method, eg. `Add(rpcConn, a, b int) int`
+		if !explicit || err != nil {
+			if checkErr := checkMethodType(fValue.Type()); checkErr == nil {
+				rpc.Register(name, fValue.Interface(), options.inCodec, options.outCodec)
+				err = nil
+			} else if err == nil {
+				err = checkErr
+			}
+		}
+		if err != nil {
+			skipped = append(skipped, RPCSkippedMethod{
+				Name:   m.Name,
+				Reason: err.Error()})
+		}
+	}
+	return skipped, nil
+}
+
+// isExplicitMethodType checks whether fType looks like a function for RegisterExplicitly
+func isExplicitMethodType(fType reflect.Type) bool {
+	nIn := fType.NumIn()
+	switch {
+	case nIn == 3:
+		return fType.In(0) == typeOfPointToRPCConn
+	case nIn == 4:
+		return fType.In(0) == typeOfContext && fType.In(1) == typeOfPointToRPCConn
+	}
+	return false
+}
+
+// checkMethodType checks whether fType can be registered via Register
+func checkMethodType(fType reflect.Type) error {
+	if fType.IsVariadic() {
+		return errors.New("variadic function is not supported")
+	}
+	inParamInfo := getAllInParamInfo(fType)
+	if len(inParamInfo) > 0 && inParamInfo[0] == typeOfContext {
+		inParamInfo = inParamInfo[1:]
+	}
+	if len(inParamInfo) > 0 && inParamInfo[0] == typeOfPointToRPCConn {
+		inParamInfo = inParamInfo[1:]
+	}
+	if len(inParamInfo) > 0 && inParamInfo[0] == typeOfPointToRPCStream {
+		inParamInfo = inParamInfo[1:]
+	}
+	for _, pType := range inParamInfo {
+		if err := checkParamType(pType); err != nil {
+			return err
+		}
+	}
+	outParamInfo := getAllOutParamInfo(fType)
+	if len(outParamInfo) > 0 && outParamInfo[len(outParamInfo)-1] == typeOfError {
+		outParamInfo = outParamInfo[:len(outParamInfo)-1]
+	}
+	for _, pType := range outParamInfo {
+		if err := checkParamType(pType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkParamType(pType reflect.Type) error {
+	switch {
+	case pType == typeOfContext:
+		return errors.New("context.Context must be the first in argument")
+	case pType == typeOfPointToRPCConn:
+		return errors.New("RPC connection must be the first in argument or follow the context argument")
+	case pType == typeOfPointToRPCStream:
+		return errors.New("RPC stream must follow the context and RPC connection arguments")
+	case pType == typeOfError:
+		return errors.New("error must be the last out argument")
+	}
+	switch pType.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return errors.New("type " + pType.String() + " cannot be encoded as JSON")
+	}
+	return nil
+}
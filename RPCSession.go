@@ -0,0 +1,191 @@
+package wsrpc
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+)
+
+// RPCSession is a concurrency-safe store of the user defined session data of a connection.
+type RPCSession struct {
+	mux      sync.RWMutex
+	values   map[string]interface{}
+	onChange []func(key string, oldValue interface{}, newValue interface{})
+}
+
+func newRPCSession() *RPCSession {
+	return &RPCSession{values: make(map[string]interface{})}
+}
+
+// Get returns the value stored under key, and whether it exists.
+func (s *RPCSession) Get(key string) (interface{}, bool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// Set stores value under key.
+func (s *RPCSession) Set(key string, value interface{}) {
+	s.mux.Lock()
+	oldValue := s.values[key]
+	s.values[key] = value
+	callbacks := s.onChange
+	s.mux.Unlock()
+	for _, f := range callbacks {
+		f(key, oldValue, value)
+	}
+}
+
+// Delete removes the value stored under key.
+func (s *RPCSession) Delete(key string) {
+	s.mux.Lock()
+	oldValue, ok := s.values[key]
+	delete(s.values, key)
+	callbacks := s.onChange
+	s.mux.Unlock()
+	if !ok {
+		return
+	}
+	for _, f := range callbacks {
+		f(key, oldValue, nil)
+	}
+}
+
+// LoadOrStore returns the existing value stored under key if present.
+// Otherwise, it stores and returns value. The loaded result is true if the value was loaded.
+func (s *RPCSession) LoadOrStore(key string, value interface{}) (actual interface{}, loaded bool) {
+	s.mux.Lock()
+	if actual, loaded = s.values[key]; loaded {
+		s.mux.Unlock()
+		return actual, true
+	}
+	s.values[key] = value
+	callbacks := s.onChange
+	s.mux.Unlock()
+	for _, f := range callbacks {
+		f(key, nil, value)
+	}
+	return value, false
+}
+
+// Range calls f for each key and value in the session until f returns false.
+// It works on a snapshot, so f may modify the session.
+func (s *RPCSession) Range(f func(key string, value interface{}) bool) {
+	s.mux.RLock()
+	snapshot := make(map[string]interface{}, len(s.values))
+	for key, value := range s.values {
+		snapshot[key] = value
+	}
+	s.mux.RUnlock()
+	for key, value := range snapshot {
+		if !f(key, value) {
+			return
+		}
+	}
+}
+
+// OnChange adds a callback which is called after a value is set or deleted.
+// oldValue is nil if the key did not exist, newValue is nil if the key is deleted.
+func (s *RPCSession) OnChange(f func(key string, oldValue interface{}, newValue interface{})) {
+	if f == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.onChange = append(s.onChange, f)
+}
+
+// GetString returns the value stored under key if it is a string.
+func (s *RPCSession) GetString(key string) (string, bool) {
+	value, _ := s.Get(key)
+	v, ok := value.(string)
+	return v, ok
+}
+
+// GetInt returns the value stored under key if it is an int.
+func (s *RPCSession) GetInt(key string) (int, bool) {
+	value, _ := s.Get(key)
+	v, ok := value.(int)
+	return v, ok
+}
+
+// GetBool returns the value stored under key if it is a bool.
+func (s *RPCSession) GetBool(key string) (bool, bool) {
+	value, _ := s.Get(key)
+	v, ok := value.(bool)
+	return v, ok
+}
+
+// SessionKey is a key of session whose values are of a fixed type, which is checked at runtime.
+// Declare it as a package-level variable to share it between handlers.
+type SessionKey struct {
+	name      string
+	valueType reflect.Type
+}
+
+// NewSessionKey creates a session key named name, whose values have the same type as zero.
+func NewSessionKey(name string, zero interface{}) *SessionKey {
+	valueType := reflect.TypeOf(zero)
+	if valueType == nil {
+		panic(errors.New("the type of session key cannot be nil interface"))
+	}
+	return &SessionKey{name: name, valueType: valueType}
+}
+
+// Name returns the name of the key in the session.
+func (k *SessionKey) Name() string {
+	return k.name
+}
+
+// Set stores value in s, the type of value must match the key.
+func (k *SessionKey) Set(s *RPCSession, value interface{}) error {
+	if reflect.TypeOf(value) != k.valueType {
+		return errors.New("session key " + k.name + " requires a value of type " + k.valueType.String())
+	}
+	s.Set(k.name, value)
+	return nil
+}
+
+// Load fills the value stored in s to ptr, which must be a pointer to the type of the key.
+// It returns false if the value does not exist.
+func (k *SessionKey) Load(s *RPCSession, ptr interface{}) bool {
+	ptrValue := reflect.ValueOf(ptr)
+	if ptrValue.Kind() != reflect.Ptr || ptrValue.Type().Elem() != k.valueType {
+		panic(errors.New("session key " + k.name + " requires a pointer to " + k.valueType.String()))
+	}
+	value, ok := s.Get(k.name)
+	if !ok || reflect.TypeOf(value) != k.valueType {
+		return false
+	}
+	ptrValue.Elem().Set(reflect.ValueOf(value))
+	return true
+}
+
+// Delete removes the value of the key from s.
+func (k *SessionKey) Delete(s *RPCSession) {
+	s.Delete(k.name)
+}
+
+// ConnectOption is used to customize a connection created by Connect or ConnectAdapter.
+type ConnectOption func(rpcConn *WebsocketRPCConn)
+
+// WithValue attaches a user defined value to the connection, which can be retrieved by Value.
+// It is usually a pointer to a struct describing the user of the connection.
+func WithValue(value interface{}) ConnectOption {
+	return func(rpcConn *WebsocketRPCConn) {
+		rpcConn.value = value
+	}
+}
+
+// WithSessionValue stores value under key in the session of the connection.
+func WithSessionValue(key string, value interface{}) ConnectOption {
+	return func(rpcConn *WebsocketRPCConn) {
+		rpcConn.Session.Set(key, value)
+	}
+}
+
+// Value returns the user defined value attached by WithValue.
+func (rpcConn *WebsocketRPCConn) Value() interface{} {
+	return rpcConn.value
+}
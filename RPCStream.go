@@ -0,0 +1,209 @@
+package wsrpc
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+)
+
+// StreamMethod is the name of the notification used to send partial results and progress of a call.
+// Its params are `{"id": id, "result": partial}` or `{"id": id, "progress": progress}`,
+// where id is the ID of the original request.
+const StreamMethod = "rpc.stream"
+
+// streamBufferSize is the number of items buffered for each stream call on the client side
+const streamBufferSize = 64
+
+var typeOfPointToRPCStream = reflect.TypeOf((*RPCStream)(nil))
+
+type streamContextKey struct{}
+
+type streamReceiverContextKey struct{}
+
+// RPCProgress describes the progress of a long-running call.
+type RPCProgress struct {
+	Current float64 `json:"current"`
+	Total   float64 `json:"total,omitempty"`
+	Message string  `json:"message,omitempty"`
+}
+
+type streamNotification struct {
+	ID       json.RawMessage `json:"id"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Progress *RPCProgress    `json:"progress,omitempty"`
+}
+
+// RPCStream is used by a handler to send partial results and progress to the caller
+// before the final response.
+//
+// A handler can receive it as an argument of Register (after the optional context and connection arguments),
+// or get it from the per-request context via StreamFromContext.
+// For a notification, nothing is sent.
+type RPCStream struct {
+	rpcConn *WebsocketRPCConn
+	id      json.RawMessage
+}
+
+// StreamFromContext returns the stream of the request bound to ctx, nil if there is none.
+func StreamFromContext(ctx context.Context) *RPCStream {
+	s, _ := ctx.Value(streamContextKey{}).(*RPCStream)
+	return s
+}
+
+// Send sends a partial result.
+func (s *RPCStream) Send(value interface{}) error {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return s.SendLowLevel(valueBytes)
+}
+
+// SendLowLevel sends a partial result in low-level way (use json.RawMessage).
+func (s *RPCStream) SendLowLevel(value json.RawMessage) error {
+	return s.send(streamNotification{ID: s.id, Result: value})
+}
+
+// Progress sends the progress of the call.
+func (s *RPCStream) Progress(progress RPCProgress) error {
+	return s.send(streamNotification{ID: s.id, Progress: &progress})
+}
+
+func (s *RPCStream) send(n streamNotification) error {
+	if s.id == nil {
+		return nil
+	}
+	params, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return s.rpcConn.notifyLowLevel(StreamMethod, params)
+}
+
+// RPCStreamItem is a partial result or a progress of a stream call.
+type RPCStreamItem struct {
+	// Result is the partial result, nil if it is a progress
+	Result json.RawMessage
+	// Progress is the progress, nil if it is a partial result
+	Progress *RPCProgress
+}
+
+// RPCStreamCall represents a call whose partial results and progress are streamed.
+type RPCStreamCall struct {
+	// C receives the partial results and progress in order, it is closed when the call completes.
+	C        <-chan RPCStreamItem
+	ch       chan RPCStreamItem
+	queue    []RPCStreamItem
+	ready    chan struct{}
+	finished bool
+	done     chan struct{}
+	mux      sync.Mutex
+	result   json.RawMessage
+	err      error
+}
+
+// CallStreamLowLevel calls a remote procedure in low-level way (use json.RawMessage),
+// and receives the partial results and progress sent by the peer via RPCStream.
+// ctx and Timeout are applied to the whole stream.
+//
+// Items are queued without blocking the read loop of the connection, and C is closed after all of them
+// are received, so the final result never overtakes them. C should be drained (or Wait should be called),
+// otherwise the queued items are kept in memory.
+func (rpcConn *WebsocketRPCConn) CallStreamLowLevel(ctx context.Context, name string, params json.RawMessage) *RPCStreamCall {
+	call := &RPCStreamCall{
+		ch:    make(chan RPCStreamItem, streamBufferSize),
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{})}
+	call.C = call.ch
+	go call.pump()
+	go func() {
+		ctx := context.WithValue(ctx, streamReceiverContextKey{}, call)
+		err := rpcConn.CallLowLevelContext(ctx, name, params, &call.result)
+		call.mux.Lock()
+		call.err = err
+		call.finished = true
+		call.mux.Unlock()
+		call.notify()
+	}()
+	return call
+}
+
+// pump moves the queued items to C, and closes C when the call is finished and all the items are moved
+func (c *RPCStreamCall) pump() {
+	defer close(c.done)
+	defer close(c.ch)
+	for {
+		c.mux.Lock()
+		items := c.queue
+		c.queue = nil
+		finished := c.finished
+		c.mux.Unlock()
+		for _, item := range items {
+			c.ch <- item
+		}
+		if len(items) == 0 {
+			if finished {
+				return
+			}
+			<-c.ready
+		}
+	}
+}
+
+func (c *RPCStreamCall) notify() {
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// CallStreamExplicitly is like CallStreamLowLevel but params are defined explicitly by the caller.
+func (rpcConn *WebsocketRPCConn) CallStreamExplicitly(ctx context.Context, name string, params interface{}) (*RPCStreamCall, error) {
+	paramBytes, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	return rpcConn.CallStreamLowLevel(ctx, name, paramBytes), nil
+}
+
+// Wait discards the remaining items and waits for the final result.
+func (c *RPCStreamCall) Wait() (json.RawMessage, error) {
+	for range c.ch {
+		// discard
+	}
+	<-c.done
+	return c.result, c.err
+}
+
+// WaitExplicitly is like Wait but the final result is unmarshalled to reply.
+func (c *RPCStreamCall) WaitExplicitly(reply interface{}) error {
+	result, err := c.Wait()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(result, reply)
+}
+
+// deliver queues an item, it never blocks the read loop
+func (c *RPCStreamCall) deliver(item RPCStreamItem) {
+	c.mux.Lock()
+	if c.finished {
+		c.mux.Unlock()
+		return
+	}
+	c.queue = append(c.queue, item)
+	c.mux.Unlock()
+	c.notify()
+}
+
+// processStream delivers a stream notification, it is called in the read loop
+func (rpcConn *WebsocketRPCConn) processStream(params json.RawMessage) {
+	var n streamNotification
+	if err := json.Unmarshal(params, &n); err != nil || n.ID == nil {
+		return
+	}
+	if call, ok := rpcConn.streams.Load(requestKey(n.ID)); ok {
+		call.(*RPCStreamCall).deliver(RPCStreamItem{Result: n.Result, Progress: n.Progress})
+	}
+}
@@ -0,0 +1,361 @@
+package wsrpc
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// SubscribeMethod is the name of the built-in method to subscribe to a topic.
+	// Its params are `["topic"]` or `{"topic": "topic"}`, and its result is the subscription ID.
+	SubscribeMethod = "rpc.subscribe"
+	// UnsubscribeMethod is the name of the built-in method to cancel a subscription.
+	// Its params are `["id"]` or `{"subscription": "id"}`, and its result is whether the subscription existed.
+	UnsubscribeMethod = "rpc.unsubscribe"
+	// SubscriptionMethod is the name of the notification sent to subscribers.
+	// Its params are `{"subscription": "id", "result": payload}`.
+	SubscriptionMethod = "rpc.subscription"
+)
+
+// subscriptionBufferSize is the number of notifications buffered for each subscription on the client side
+const subscriptionBufferSize = 64
+
+// maxOrphanSubscriptions limits the number of unknown subscriptions whose notifications are buffered
+const maxOrphanSubscriptions = 16
+
+// orphanSubscription buffers the notifications which arrive before the response of SubscribeMethod
+type orphanSubscription struct {
+	payloads []json.RawMessage
+	dropped  uint64
+}
+
+var typesOfSubscriptionParams = []reflect.Type{reflect.TypeOf("")}
+
+type subscriptionNotification struct {
+	Subscription string          `json:"subscription"`
+	Result       json.RawMessage `json:"result"`
+}
+
+type serverSubscription struct {
+	topic   string
+	rpcConn *WebsocketRPCConn
+}
+
+// subscriptionRegistry saves the subscriptions on the server side
+type subscriptionRegistry struct {
+	seq    uint64
+	mux    sync.RWMutex
+	topics map[string]map[string]*WebsocketRPCConn
+	byID   map[string]serverSubscription
+	byConn map[*WebsocketRPCConn]map[string]struct{}
+}
+
+func newSubscriptionRegistry() *subscriptionRegistry {
+	return &subscriptionRegistry{
+		topics: make(map[string]map[string]*WebsocketRPCConn),
+		byID:   make(map[string]serverSubscription),
+		byConn: make(map[*WebsocketRPCConn]map[string]struct{})}
+}
+
+func (r *subscriptionRegistry) subscribe(rpcConn *WebsocketRPCConn, topic string) string {
+	id := "0x" + strconv.FormatUint(atomic.AddUint64(&r.seq, 1), 16)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.topics[topic] == nil {
+		r.topics[topic] = make(map[string]*WebsocketRPCConn)
+	}
+	r.topics[topic][id] = rpcConn
+	r.byID[id] = serverSubscription{topic: topic, rpcConn: rpcConn}
+	if r.byConn[rpcConn] == nil {
+		r.byConn[rpcConn] = make(map[string]struct{})
+	}
+	r.byConn[rpcConn][id] = struct{}{}
+	return id
+}
+
+// unsubscribeLocked removes the subscription if it belongs to rpcConn, the caller must hold the lock
+func (r *subscriptionRegistry) unsubscribeLocked(rpcConn *WebsocketRPCConn, id string) bool {
+	sub, ok := r.byID[id]
+	if !ok || sub.rpcConn != rpcConn {
+		return false
+	}
+	delete(r.byID, id)
+	delete(r.topics[sub.topic], id)
+	if len(r.topics[sub.topic]) == 0 {
+		delete(r.topics, sub.topic)
+	}
+	delete(r.byConn[rpcConn], id)
+	if len(r.byConn[rpcConn]) == 0 {
+		delete(r.byConn, rpcConn)
+	}
+	return true
+}
+
+func (r *subscriptionRegistry) unsubscribe(rpcConn *WebsocketRPCConn, id string) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.unsubscribeLocked(rpcConn, id)
+}
+
+func (r *subscriptionRegistry) removeConn(rpcConn *WebsocketRPCConn) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for id := range r.byConn[rpcConn] {
+		r.unsubscribeLocked(rpcConn, id)
+	}
+}
+
+// EnableSubscriptions registers the built-in methods SubscribeMethod and UnsubscribeMethod,
+// so that peers can subscribe to the topics published via Publish.
+// Subscriptions are removed automatically when the connection is closed.
+func (rpc *WebsocketRPC) EnableSubscriptions() {
+	topicCodec := NewRPCMixedParamsCodec([]string{"topic"})
+	idCodec := NewRPCMixedParamsCodec([]string{"subscription"})
+	rpc.RegisterLowLevelContext(SubscribeMethod, func(_ context.Context, rpcConn *WebsocketRPCConn, arg json.RawMessage, reply *json.RawMessage) error {
+		args, err := topicCodec.Decode(arg, typesOfSubscriptionParams)
+		if err != nil {
+			return RPCInvalidParamsError
+		}
+		id := rpc.subscriptions.subscribe(rpcConn, args[0].String())
+		*reply, err = json.Marshal(id)
+		return err
+	})
+	rpc.RegisterLowLevelContext(UnsubscribeMethod, func(_ context.Context, rpcConn *WebsocketRPCConn, arg json.RawMessage, reply *json.RawMessage) error {
+		args, err := idCodec.Decode(arg, typesOfSubscriptionParams)
+		if err != nil {
+			return RPCInvalidParamsError
+		}
+		ok := rpc.subscriptions.unsubscribe(rpcConn, args[0].String())
+		*reply, err = json.Marshal(ok)
+		return err
+	})
+}
+
+// Publish sends payload to all the subscribers of topic.
+// It returns the number of subscriptions to which the payload is sent successfully.
+func (rpc *WebsocketRPC) Publish(topic string, payload interface{}) (int, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	return rpc.PublishLowLevel(topic, payloadBytes), nil
+}
+
+// PublishLowLevel is like Publish but the payload is a json.RawMessage.
+// The payload is written to the subscribers concurrently, interceptors are not applied.
+func (rpc *WebsocketRPC) PublishLowLevel(topic string, payload json.RawMessage) int {
+	rpc.subscriptions.mux.RLock()
+	subscribers := make(map[string]*WebsocketRPCConn, len(rpc.subscriptions.topics[topic]))
+	for id, rpcConn := range rpc.subscriptions.topics[topic] {
+		subscribers[id] = rpcConn
+	}
+	rpc.subscriptions.mux.RUnlock()
+	var sent int64
+	var wg sync.WaitGroup
+	for id, rpcConn := range subscribers {
+		params, err := json.Marshal(subscriptionNotification{Subscription: id, Result: payload})
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(rpcConn *WebsocketRPCConn, params json.RawMessage) {
+			defer wg.Done()
+			if rpcConn.notifyLowLevel(SubscriptionMethod, params) == nil {
+				atomic.AddInt64(&sent, 1)
+			}
+		}(rpcConn, params)
+	}
+	wg.Wait()
+	return int(sent)
+}
+
+// RPCSubscription represents a subscription to a topic on the client side.
+type RPCSubscription struct {
+	// ID is the subscription ID assigned by the peer
+	ID string
+	// Topic is the subscribed topic
+	Topic string
+	// C receives the payloads in channel mode, it is closed when the subscription ends.
+	// It is nil if the subscription is created by SubscribeFunc.
+	C       <-chan json.RawMessage
+	ch      chan json.RawMessage
+	dropped uint64
+	rpcConn *WebsocketRPCConn
+	closed  chan struct{}
+	once    sync.Once
+	mux     sync.Mutex
+}
+
+// Subscribe subscribes to topic on the peer, the payloads are received from the channel C of the subscription.
+//
+// Notifications are delivered in the read loop of the connection, so that they are kept in order.
+// The read loop never waits for a slow consumer, the payloads are dropped when the buffer of C is full,
+// see Dropped.
+func (rpcConn *WebsocketRPCConn) Subscribe(topic string) (*RPCSubscription, error) {
+	return rpcConn.subscribe(topic, nil)
+}
+
+// SubscribeFunc subscribes to topic on the peer, callback is called with each payload
+// one by one in a dedicated goroutine. Like Subscribe, the payloads are dropped if callback falls behind.
+func (rpcConn *WebsocketRPCConn) SubscribeFunc(topic string, callback func(payload json.RawMessage)) (*RPCSubscription, error) {
+	return rpcConn.subscribe(topic, callback)
+}
+
+func (rpcConn *WebsocketRPCConn) subscribe(topic string, callback func(payload json.RawMessage)) (*RPCSubscription, error) {
+	params, err := json.Marshal([]string{topic})
+	if err != nil {
+		return nil, err
+	}
+	// Notifications of unknown subscriptions are buffered only while subscribing
+	rpcConn.subsMux.Lock()
+	rpcConn.subscribing++
+	rpcConn.subsMux.Unlock()
+	var reply json.RawMessage
+	err = rpcConn.CallLowLevel(SubscribeMethod, params, &reply)
+	var id string
+	if err == nil {
+		err = json.Unmarshal(reply, &id)
+	}
+	if err != nil {
+		rpcConn.subsMux.Lock()
+		rpcConn.endSubscribeLocked()
+		rpcConn.subsMux.Unlock()
+		return nil, err
+	}
+	sub := &RPCSubscription{
+		ID:      id,
+		Topic:   topic,
+		ch:      make(chan json.RawMessage, subscriptionBufferSize),
+		rpcConn: rpcConn,
+		closed:  make(chan struct{})}
+	if callback == nil {
+		sub.C = sub.ch
+	} else {
+		go func() {
+			for payload := range sub.ch {
+				callback(payload)
+			}
+		}()
+	}
+	rpcConn.subsMux.Lock()
+	// Notifications may arrive before the response of SubscribeMethod
+	if orphan, ok := rpcConn.orphans[id]; ok {
+		sub.dropped = orphan.dropped
+		for _, payload := range orphan.payloads {
+			sub.deliver(payload)
+		}
+		delete(rpcConn.orphans, id)
+	}
+	rpcConn.subs[id] = sub
+	rpcConn.endSubscribeLocked()
+	rpcConn.subsMux.Unlock()
+	select {
+	case <-rpcConn.done:
+		sub.close()
+	default:
+	}
+	return sub, nil
+}
+
+// endSubscribeLocked marks a subscribe call as finished, the caller must hold subsMux.
+// When no subscribe call is pending, the buffers of unknown subscriptions are expired.
+func (rpcConn *WebsocketRPCConn) endSubscribeLocked() {
+	rpcConn.subscribing--
+	if rpcConn.subscribing == 0 {
+		rpcConn.orphans = make(map[string]*orphanSubscription)
+		rpcConn.unsubscribed = make(map[string]struct{})
+	}
+}
+
+// Unsubscribe cancels the subscription on the peer and closes C.
+func (s *RPCSubscription) Unsubscribe() error {
+	s.rpcConn.subsMux.Lock()
+	delete(s.rpcConn.subs, s.ID)
+	// Notifications in flight are discarded instead of being buffered for a pending subscribe call
+	s.rpcConn.unsubscribed[s.ID] = struct{}{}
+	delete(s.rpcConn.orphans, s.ID)
+	s.rpcConn.subsMux.Unlock()
+	s.close()
+	params, err := json.Marshal([]string{s.ID})
+	if err != nil {
+		return err
+	}
+	return s.rpcConn.CallLowLevel(UnsubscribeMethod, params, nil)
+}
+
+// Dropped returns the number of payloads dropped because the buffer of C is full.
+func (s *RPCSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *RPCSubscription) close() {
+	s.once.Do(func() {
+		close(s.closed)
+		s.mux.Lock()
+		close(s.ch)
+		s.mux.Unlock()
+	})
+}
+
+func (s *RPCSubscription) deliver(payload json.RawMessage) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+	// Never block the read loop, otherwise responses are stalled behind a slow consumer
+	select {
+	case s.ch <- payload:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// processSubscription delivers a subscription notification, it is called in the read loop
+func (rpcConn *WebsocketRPCConn) processSubscription(params json.RawMessage) {
+	var n subscriptionNotification
+	if err := json.Unmarshal(params, &n); err != nil {
+		return
+	}
+	rpcConn.subsMux.Lock()
+	sub, ok := rpcConn.subs[n.Subscription]
+	if !ok {
+		if _, unsubscribed := rpcConn.unsubscribed[n.Subscription]; unsubscribed || rpcConn.subscribing == 0 {
+			rpcConn.subsMux.Unlock()
+			return
+		}
+		orphan, ok := rpcConn.orphans[n.Subscription]
+		if !ok && len(rpcConn.orphans) < maxOrphanSubscriptions {
+			orphan = new(orphanSubscription)
+			rpcConn.orphans[n.Subscription] = orphan
+		}
+		if orphan != nil {
+			if len(orphan.payloads) < subscriptionBufferSize {
+				orphan.payloads = append(orphan.payloads, n.Result)
+			} else {
+				orphan.dropped++
+			}
+		}
+		rpcConn.subsMux.Unlock()
+		return
+	}
+	rpcConn.subsMux.Unlock()
+	sub.deliver(n.Result)
+}
+
+// closeSubscriptions ends all the subscriptions on the client side
+func (rpcConn *WebsocketRPCConn) closeSubscriptions() {
+	rpcConn.subsMux.Lock()
+	subs := rpcConn.subs
+	rpcConn.subs = make(map[string]*RPCSubscription)
+	rpcConn.subsMux.Unlock()
+	for _, sub := range subs {
+		sub.close()
+	}
+}
@@ -0,0 +1,108 @@
+package wsrpc
+
+import "sync/atomic"
+
+// OverloadPolicy represents what to do when the concurrency limit is reached.
+type OverloadPolicy int
+
+const (
+	// OverloadBlock stops reading messages until a worker is available,
+	// so that the peer is slowed down by the transport.
+	//
+	// Note that responses are not read either while blocking, so handlers waiting
+	// for the response of a call to the peer keep their workers until the call times out.
+	OverloadBlock OverloadPolicy = iota
+	// OverloadReject rejects the requests with RPCServerBusyError and drops the notifications.
+	OverloadReject
+)
+
+// RPCWorkerStats describes the load of message processing.
+type RPCWorkerStats struct {
+	// Running is the number of messages being processed
+	Running int64
+	// Queued is the number of messages waiting for a worker
+	Queued int64
+	// Rejected is the total number of messages rejected due to overload
+	Rejected uint64
+}
+
+type workerPool struct {
+	running  int64
+	queued   int64
+	rejected uint64
+	sem      chan struct{}
+}
+
+func (p *workerPool) stats() RPCWorkerStats {
+	return RPCWorkerStats{
+		Running:  atomic.LoadInt64(&p.running),
+		Queued:   atomic.LoadInt64(&p.queued),
+		Rejected: atomic.LoadUint64(&p.rejected)}
+}
+
+// Stats returns the load of message processing over all connections.
+func (rpc *WebsocketRPC) Stats() RPCWorkerStats {
+	return rpc.workers.stats()
+}
+
+// Stats returns the load of message processing on this connection.
+func (rpcConn *WebsocketRPCConn) Stats() RPCWorkerStats {
+	return rpcConn.workers.stats()
+}
+
+func (rpc *WebsocketRPC) initWorkers() {
+	rpc.workersOnce.Do(func() {
+		if rpc.MaxConcurrency > 0 {
+			rpc.workers.sem = make(chan struct{}, rpc.MaxConcurrency)
+		}
+	})
+}
+
+// acquireWorker acquires a worker from both the connection and the RPC service
+func (rpcConn *WebsocketRPCConn) acquireWorker() bool {
+	pools := [2]*workerPool{rpcConn.workers, rpcConn.RPC.workers}
+	if rpcConn.RPC.OverloadPolicy == OverloadReject {
+		for i, p := range pools {
+			if p.sem == nil {
+				continue
+			}
+			select {
+			case p.sem <- struct{}{}:
+			default:
+				for _, acquired := range pools[:i] {
+					if acquired.sem != nil {
+						<-acquired.sem
+					}
+				}
+				atomic.AddUint64(&rpcConn.workers.rejected, 1)
+				atomic.AddUint64(&rpcConn.RPC.workers.rejected, 1)
+				return false
+			}
+		}
+	} else {
+		for _, p := range pools {
+			atomic.AddInt64(&p.queued, 1)
+		}
+		for _, p := range pools {
+			if p.sem != nil {
+				p.sem <- struct{}{}
+			}
+		}
+		for _, p := range pools {
+			atomic.AddInt64(&p.queued, -1)
+		}
+	}
+	for _, p := range pools {
+		atomic.AddInt64(&p.running, 1)
+	}
+	return true
+}
+
+func (rpcConn *WebsocketRPCConn) releaseWorker() {
+	for _, p := range [2]*workerPool{rpcConn.workers, rpcConn.RPC.workers} {
+		atomic.AddInt64(&p.running, -1)
+		if p.sem != nil {
+			<-p.sem
+		}
+	}
+}
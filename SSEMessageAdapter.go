@@ -0,0 +1,355 @@
+package wsrpc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sseSessionEvent is the name of the first event of an SSE stream, whose data is the session ID
+const sseSessionEvent = "session"
+
+// sseSessionParam is the name of the query parameter which carries the session ID of a POST request
+const sseSessionParam = "session"
+
+// SSERPCHandler is an http.Handler that serves the RPC service over Server-Sent Events with POST fallback,
+// for the networks where websocket upgrades are not available.
+//
+// A client opens an SSE stream via GET, and the first event (named `session`) carries a session ID.
+// Then the server sends messages (responses, notifications and calls) as the events of the stream,
+// and the client sends messages via POST to the same URL with `?session=ID`, which is responded with status 202.
+// The connection is closed when the SSE stream ends. See NewSSEMessageAdapter for the client side.
+type SSERPCHandler struct {
+	//RPC is a pointer to the RPC service
+	RPC *WebsocketRPC
+	//InitSession is called before serving a connection to initialize it with the HTTP request of the SSE stream,
+	//the stream is rejected with status 403 if it returns an error.
+	InitSession func(rpcConn *WebsocketRPCConn, r *http.Request) error
+	//KeepaliveInterval sets the interval of the comments sent to keep the stream alive through proxies,
+	//default is 15 seconds.
+	KeepaliveInterval time.Duration
+	//MaxBodySize limits the size in bytes of a POST request body, default is DefaultMaxBodySize.
+	MaxBodySize int64
+	sessions    map[string]*sseServerAdapter
+	sessionsMux sync.Mutex
+}
+
+// SSEHandler creates an http.Handler which serves the RPC service over SSE with POST fallback,
+// eg. `http.Handle("/rpc/sse", rpc.SSEHandler())`.
+func (rpc *WebsocketRPC) SSEHandler() *SSERPCHandler {
+	return &SSERPCHandler{RPC: rpc}
+}
+
+// sseServerAdapter is the adapter of a connection on the server side of SSE transport
+type sseServerAdapter struct {
+	in        chan []byte
+	out       chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (a *sseServerAdapter) ReadMessage() ([]byte, error) {
+	select {
+	case data := <-a.in:
+		return data, nil
+	case <-a.closed:
+		return nil, io.EOF
+	}
+}
+
+func (a *sseServerAdapter) WriteMessage(data []byte) error {
+	select {
+	case a.out <- data:
+		return nil
+	case <-a.closed:
+		return ErrConnectionClosed
+	}
+}
+
+func (a *sseServerAdapter) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.closed)
+	})
+	return nil
+}
+
+// ServeHTTP serves an SSE stream for GET, or receives a message for POST.
+func (h *SSERPCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.serveStream(w, r)
+	case http.MethodPost:
+		h.receive(w, r)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *SSERPCHandler) serveStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	principal, err := h.RPC.AuthenticateRequest(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	var idBytes [16]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(idBytes[:])
+	adapter := &sseServerAdapter{
+		in:     make(chan []byte),
+		out:    make(chan []byte),
+		closed: make(chan struct{})}
+	rpcConn := h.RPC.ConnectAdapter(adapter, WithPrincipal(principal))
+	if h.InitSession != nil {
+		if err := h.InitSession(rpcConn, r); err != nil {
+			_ = rpcConn.Close()
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	h.sessionsMux.Lock()
+	if h.sessions == nil {
+		h.sessions = make(map[string]*sseServerAdapter)
+	}
+	h.sessions[id] = adapter
+	h.sessionsMux.Unlock()
+	defer func() {
+		h.sessionsMux.Lock()
+		delete(h.sessions, id)
+		h.sessionsMux.Unlock()
+		_ = rpcConn.Close()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := writeSSEEvent(w, sseSessionEvent, []byte(id)); err != nil {
+		return
+	}
+	flusher.Flush()
+	go rpcConn.ServeConn()
+	interval := h.KeepaliveInterval
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case data := <-adapter.out:
+			err = writeSSEEvent(w, "", data)
+		case <-ticker.C:
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		case <-adapter.closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (h *SSERPCHandler) receive(w http.ResponseWriter, r *http.Request) {
+	h.sessionsMux.Lock()
+	adapter, ok := h.sessions[r.URL.Query().Get(sseSessionParam)]
+	h.sessionsMux.Unlock()
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	maxBodySize := h.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > maxBodySize {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	select {
+	case adapter.in <- body:
+		w.WriteHeader(http.StatusAccepted)
+	case <-adapter.closed:
+		http.Error(w, "session closed", http.StatusGone)
+	case <-r.Context().Done():
+	}
+}
+
+func writeSSEEvent(w io.Writer, event string, data []byte) error {
+	var buf bytes.Buffer
+	if event != "" {
+		buf.WriteString("event: " + event + "\n")
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// SSEMessageAdapter is an adapter for rpc services to work with SSERPCHandler,
+// it receives messages from an SSE stream and sends messages via POST.
+type SSEMessageAdapter struct {
+	client    *http.Client
+	postURL   string
+	body      io.ReadCloser
+	reader    *bufio.Reader
+	mux       sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSSEMessageAdapter opens an SSE stream to rawURL (served by SSERPCHandler) and creates an adapter on it.
+// client can be nil to use http.DefaultClient, it must not have a timeout which breaks the long-lived stream.
+func NewSSEMessageAdapter(rawURL string, client *http.Client) (*SSEMessageAdapter, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New("unexpected status of SSE stream: " + resp.Status)
+	}
+	a := &SSEMessageAdapter{
+		client: client,
+		body:   resp.Body,
+		reader: bufio.NewReader(resp.Body),
+		closed: make(chan struct{})}
+	event, data, err := a.readEvent()
+	if err != nil || event != sseSessionEvent {
+		resp.Body.Close()
+		return nil, errors.New("invalid SSE stream: the session is not received")
+	}
+	postURL, err := url.Parse(rawURL)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	query := postURL.Query()
+	query.Set(sseSessionParam, string(data))
+	postURL.RawQuery = query.Encode()
+	a.postURL = postURL.String()
+	return a, nil
+}
+
+// readEvent reads the next event of the stream, comments are skipped
+func (a *SSEMessageAdapter) readEvent() (string, []byte, error) {
+	var event string
+	var data [][]byte
+	hasData := false
+	for {
+		line, err := a.reader.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if hasData {
+				return event, bytes.Join(data, []byte("\n")), nil
+			}
+			event = ""
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data = append(data, []byte(value))
+			hasData = true
+		}
+	}
+}
+
+// ReadMessage reads a message. If the connection is closed, this function must return an error.
+func (a *SSEMessageAdapter) ReadMessage() ([]byte, error) {
+	for {
+		event, data, err := a.readEvent()
+		if err != nil {
+			select {
+			case <-a.closed:
+				return nil, ErrConnectionClosed
+			default:
+				return nil, err
+			}
+		}
+		// Unnamed events are messages
+		if event == "" || event == "message" {
+			return data, nil
+		}
+	}
+}
+
+// WriteMessage writes a message. If the connection is closed, this function must return an error.
+func (a *SSEMessageAdapter) WriteMessage(data []byte) error {
+	select {
+	case <-a.closed:
+		return ErrConnectionClosed
+	default:
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	resp, err := a.client.Post(a.postURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusAccepted {
+		return errors.New("unexpected status of POST: " + resp.Status)
+	}
+	return nil
+}
+
+// Close closes the SSE stream, which closes the connection on the server side.
+func (a *SSEMessageAdapter) Close() error {
+	var err error
+	a.closeOnce.Do(func() {
+		close(a.closed)
+		err = a.body.Close()
+	})
+	return err
+}
@@ -0,0 +1,231 @@
+package wsrpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MessageFraming represents how messages are delimited in a byte stream.
+type MessageFraming int
+
+const (
+	// FramingNewline delimits messages with `\n` (newline-delimited JSON).
+	FramingNewline MessageFraming = iota
+	// FramingContentLength prefixes each message with LSP-style headers, eg. `Content-Length: 42\r\n\r\n`.
+	FramingContentLength
+	// FramingLengthPrefix prefixes each message with its length as a 4-byte big-endian integer.
+	FramingLengthPrefix
+)
+
+// DefaultMaxFrameSize is the default limit of the size of a message in a byte stream.
+const DefaultMaxFrameSize = 32 << 20
+
+// ErrFrameTooLarge is returned when a message exceeds the max frame size,
+// or the headers of a message with FramingContentLength are too large.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+const (
+	// maxHeaderLineSize limits the size of a header line with FramingContentLength
+	maxHeaderLineSize = 4 << 10
+	// maxHeaderSize limits the total size of the headers of a message with FramingContentLength
+	maxHeaderSize = 64 << 10
+	// maxPreallocSize limits the buffer allocated for a message before its data is received
+	maxPreallocSize = 64 << 10
+)
+
+// StreamMessageAdapter is an adapter for rpc services to work over a byte stream (eg. net.Conn),
+// messages are delimited by the specified framing.
+type StreamMessageAdapter struct {
+	rwc          io.ReadWriteCloser
+	reader       *bufio.Reader
+	framing      MessageFraming
+	maxFrameSize int
+	mux          sync.Mutex
+}
+
+// NewStreamMessageAdapter creates a adapter over rwc with the specified framing.
+func NewStreamMessageAdapter(rwc io.ReadWriteCloser, framing MessageFraming) *StreamMessageAdapter {
+	return &StreamMessageAdapter{
+		rwc:          rwc,
+		reader:       bufio.NewReader(rwc),
+		framing:      framing,
+		maxFrameSize: DefaultMaxFrameSize}
+}
+
+// SetMaxFrameSize sets the limit of the size of a message in bytes, 0 means unlimited.
+// ErrFrameTooLarge is returned if a message to read or write exceeds the limit.
+// It must be called before ServeConn.
+func (a *StreamMessageAdapter) SetMaxFrameSize(size int) {
+	a.maxFrameSize = size
+}
+
+func (a *StreamMessageAdapter) tooLarge(size int) bool {
+	return a.maxFrameSize > 0 && size > a.maxFrameSize
+}
+
+// ReadMessage reads a message. If the connection is closed, this function must return an error.
+func (a *StreamMessageAdapter) ReadMessage() ([]byte, error) {
+	switch a.framing {
+	case FramingNewline:
+		return a.readLine()
+	case FramingContentLength:
+		return a.readContentLength()
+	case FramingLengthPrefix:
+		return a.readLengthPrefix()
+	}
+	return nil, errors.New("unknown framing")
+}
+
+func (a *StreamMessageAdapter) readLine() ([]byte, error) {
+	for {
+		var line []byte
+		for {
+			chunk, err := a.reader.ReadSlice('\n')
+			if a.tooLarge(len(line) + len(chunk)) {
+				return nil, ErrFrameTooLarge
+			}
+			line = append(line, chunk...)
+			if err == nil {
+				break
+			}
+			if err != bufio.ErrBufferFull {
+				return nil, err
+			}
+		}
+		line = bytes.TrimSpace(line)
+		// Skip empty lines
+		if len(line) != 0 {
+			return line, nil
+		}
+	}
+}
+
+// readHeaderLine reads a line, ErrFrameTooLarge is returned if it exceeds maxHeaderLineSize
+func (a *StreamMessageAdapter) readHeaderLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := a.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxHeaderLineSize {
+			return "", ErrFrameTooLarge
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			return string(line), nil
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+}
+
+func (a *StreamMessageAdapter) readContentLength() ([]byte, error) {
+	length := -1
+	headerSize := 0
+	for {
+		line, err := a.readHeaderLine()
+		if err != nil {
+			return nil, err
+		}
+		headerSize += len(line)
+		if headerSize > maxHeaderSize {
+			return nil, ErrFrameTooLarge
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if length >= 0 {
+				break
+			}
+			// Skip empty lines between messages
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, errors.New("invalid header: " + line)
+		}
+		if strings.EqualFold(strings.TrimSpace(line[:i]), "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(line[i+1:]))
+			if err != nil || length < 0 {
+				return nil, errors.New("invalid Content-Length: " + line[i+1:])
+			}
+		}
+	}
+	if a.tooLarge(length) {
+		return nil, ErrFrameTooLarge
+	}
+	return a.readFrame(length)
+}
+
+func (a *StreamMessageAdapter) readLengthPrefix() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(a.reader, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if a.tooLarge(int(length)) {
+		return nil, ErrFrameTooLarge
+	}
+	return a.readFrame(int(length))
+}
+
+// readFrame reads a message of length bytes. The buffer grows as the data is received,
+// so that a bogus length (eg. with an unlimited max frame size) cannot exhaust the memory in advance.
+func (a *StreamMessageAdapter) readFrame(length int) ([]byte, error) {
+	if length <= maxPreallocSize {
+		message := make([]byte, length)
+		_, err := io.ReadFull(a.reader, message)
+		return message, err
+	}
+	var buf bytes.Buffer
+	buf.Grow(maxPreallocSize)
+	n, err := io.CopyN(&buf, a.reader, int64(length))
+	if err == io.EOF && n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+// WriteMessage writes a message. If the connection is closed, this function must return an error.
+func (a *StreamMessageAdapter) WriteMessage(data []byte) error {
+	if a.framing == FramingNewline && bytes.IndexByte(data, '\n') >= 0 {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, data); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	if a.tooLarge(len(data)) {
+		return ErrFrameTooLarge
+	}
+	var frame []byte
+	switch a.framing {
+	case FramingNewline:
+		frame = make([]byte, 0, len(data)+1)
+		frame = append(frame, data...)
+		frame = append(frame, '\n')
+	case FramingContentLength:
+		frame = []byte("Content-Length: " + strconv.Itoa(len(data)) + "\r\n\r\n")
+		frame = append(frame, data...)
+	case FramingLengthPrefix:
+		frame = make([]byte, 4, len(data)+4)
+		binary.BigEndian.PutUint32(frame, uint32(len(data)))
+		frame = append(frame, data...)
+	default:
+		return errors.New("unknown framing")
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	_, err := a.rwc.Write(frame)
+	return err
+}
+
+// Close closes the underlying stream.
+func (a *StreamMessageAdapter) Close() error {
+	return a.rwc.Close()
+}
@@ -2,24 +2,44 @@ package wsrpc
 
 import (
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 // WebsocketMessageAdapter is an adapter for rpc services to work with gorilla/websocket
 type WebsocketMessageAdapter struct {
-	conn *websocket.Conn
-	mux  sync.Mutex
+	conn      *websocket.Conn
+	mux       sync.Mutex
+	interval  time.Duration
+	timeout   time.Duration
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 // NewWebsocketMessageAdapter creates a adapter.
 func NewWebsocketMessageAdapter(conn *websocket.Conn) *WebsocketMessageAdapter {
-	return &WebsocketMessageAdapter{conn: conn}
+	return &WebsocketMessageAdapter{conn: conn, stop: make(chan struct{})}
+}
+
+// SetKeepalive sends a ping to the peer every interval, and fails ReadMessage with ErrHeartbeatTimeout
+// (thus closes the RPC connection) if neither a pong nor a message is received within interval + timeout.
+// It must be called before ServeConn, and only once.
+func (a *WebsocketMessageAdapter) SetKeepalive(interval time.Duration, timeout time.Duration) {
+	a.interval = interval
+	a.timeout = timeout
+	startKeepalive(a.conn, interval, timeout, a.stop)
 }
 
 // ReadMessage reads a message. If the connection is closed, this function must return an error.
 func (a *WebsocketMessageAdapter) ReadMessage() ([]byte, error) {
 	_, message, err := a.conn.ReadMessage()
+	if a.interval > 0 {
+		if err != nil {
+			return nil, keepaliveError(err)
+		}
+		_ = a.conn.SetReadDeadline(time.Now().Add(a.interval + a.timeout))
+	}
 	return message, err
 }
 
@@ -29,3 +49,11 @@ func (a *WebsocketMessageAdapter) WriteMessage(data []byte) error {
 	defer a.mux.Unlock()
 	return a.conn.WriteMessage(websocket.TextMessage, data)
 }
+
+// Close closes the underlying websocket connection.
+func (a *WebsocketMessageAdapter) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.stop)
+	})
+	return a.conn.Close()
+}
@@ -1,9 +1,14 @@
 package wsrpc
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"reflect"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,6 +19,22 @@ import (
 // LowLevelRPCMethod is an RPC method that send and receive raw messages
 type LowLevelRPCMethod func(rpcConn *WebsocketRPCConn, arg json.RawMessage, reply *json.RawMessage) error
 
+// LowLevelRPCMethodContext is like LowLevelRPCMethod but receives a per-request context,
+// which is cancelled when the request is cancelled by the caller or the connection is closed.
+type LowLevelRPCMethodContext func(ctx context.Context, rpcConn *WebsocketRPCConn, arg json.RawMessage, reply *json.RawMessage) error
+
+// ErrConnectionClosed is returned by pending and new calls when the connection is closed.
+var ErrConnectionClosed = errors.New("connection closed")
+
+var errCallTimeout = errors.New("RPC call timed out")
+
+// CancelRequestMethod is the name of the notification used to cancel a request.
+const CancelRequestMethod = "$/cancelRequest"
+
+type cancelRequestParams struct {
+	ID json.RawMessage `json:"id"`
+}
+
 type rpcMessage struct {
 	ID json.RawMessage `json:"id,omitempty"`
 
@@ -25,22 +46,110 @@ type rpcMessage struct {
 	Error  *RPCErrorInfo   `json:"error,omitempty"`
 }
 
+// BatchMode represents how the requests in a batch are executed.
+type BatchMode int
+
+const (
+	// BatchSequential executes the requests one by one in a single goroutine.
+	BatchSequential BatchMode = iota
+	// BatchParallel executes the requests concurrently, the responses are still in the order of requests.
+	BatchParallel
+)
+
 // WebsocketRPC represents an RPC service that run over websocket
 type WebsocketRPC struct {
-	method map[string]LowLevelRPCMethod
+	//EnableCancelRequest enables the `$/cancelRequest` notification.
+	//If enabled, a notification is sent to the peer when a call is abandoned,
+	//and the context of a running request is cancelled when such a notification is received.
+	EnableCancelRequest bool
+	//PanicHandler is called when a handler (including middlewares and codecs) panics.
+	//The panic is recovered and an RPCInternalError is sent to the caller.
+	PanicHandler func(req *RPCRequest, recovered interface{}, stack []byte)
+	//Debug enables debug mode, in which the panic message and the stack trace
+	//are sent to the caller in the Data field of the error.
+	Debug bool
+	//BatchMode sets how the requests in a batch are executed, default is BatchSequential.
+	BatchMode BatchMode
+	//BatchConcurrency limits the number of requests in a batch executed at the same time
+	//in BatchParallel mode, 0 means unlimited.
+	BatchConcurrency int
+	//MaxBatchSize limits the number of messages in a batch, 0 means unlimited.
+	//An RPCInvalidRequestError is sent if the limit is exceeded.
+	MaxBatchSize int
+	//MaxConcurrency limits the number of messages processed at the same time
+	//over all connections, 0 means unlimited.
+	MaxConcurrency int
+	//OverloadPolicy sets what to do when the concurrency limit is reached, default is OverloadBlock.
+	OverloadPolicy OverloadPolicy
+	//OnConnect is called when a connection starts serving (in ServeConn).
+	OnConnect func(rpcConn *WebsocketRPCConn)
+	//OnDisconnect is called when a connection is closed, err is the same as rpcConn.Err().
+	//It is not called if the connection is closed before serving, eg. when InitSession of a handler fails.
+	OnDisconnect func(rpcConn *WebsocketRPCConn, err error)
+	//TrackConnections enables the registry of live connections created by Connect and ConnectAdapter,
+	//which is required by Connections, Broadcast, etc. It must be set before creating any connection.
+	TrackConnections bool
+	//HandshakeAuthenticator authenticates connections with the HTTP upgrade request,
+	//see AuthenticateRequest.
+	HandshakeAuthenticator HandshakeAuthenticator
+	conns                  map[*WebsocketRPCConn]struct{}
+	subscriptions          *subscriptionRegistry
+	connsMux               sync.RWMutex
+	workers                *workerPool
+	workersOnce            sync.Once
+	method                 map[string]LowLevelRPCMethodContext
+	loginMethod            map[string]struct{}
+	permissions            []permissionRule
+	ordering               map[string]OrderingKeyFunc
+	middleware             []rpcMiddlewareEntry
+	interceptor            []RPCInterceptor
 }
 
 // WebsocketRPCConn represents an RPC connection to WebsocketRPC
 type WebsocketRPCConn struct {
 	//RPC is a pointer to the RPC service
 	RPC *WebsocketRPC
-	//Session saves the user defined session data
-	Session map[string]interface{}
+	//Session saves the user defined session data, it is safe for concurrent use
+	Session *RPCSession
 	//Timeout sets the time to wait for a response, default is 10 seconds
 	Timeout time.Duration
-	adapter MessageAdapter
-	seq     uint64
-	pending sync.Map
+	//MaxConcurrency limits the number of messages processed at the same time
+	//on this connection, 0 means unlimited. It must be set before ServeConn.
+	MaxConcurrency int
+	//Sequential makes all the incoming requests and notifications processed in arrival order.
+	//The built-in CancelRequestMethod and PingMethod are not queued.
+	//See also WebsocketRPC.Order for ordering per method.
+	Sequential   bool
+	workers      *workerPool
+	queues       map[string]*orderedQueue
+	queueMux     sync.Mutex
+	adapter      MessageAdapter
+	reconnector  *reconnectingAdapter
+	value        interface{}
+	principal    RPCPrincipal
+	authMux      sync.RWMutex
+	interceptor  []RPCInterceptor
+	seq          uint64
+	pending      sync.Map
+	running      sync.Map
+	streams      sync.Map
+	batches      sync.Map
+	ctx          context.Context
+	cancel       context.CancelFunc
+	handlers     sync.WaitGroup
+	closing      bool
+	serving      bool
+	finished     bool
+	closeMux     sync.Mutex
+	closeOnce    sync.Once
+	finishOnce   sync.Once
+	done         chan struct{}
+	err          error
+	subs         map[string]*RPCSubscription
+	orphans      map[string]*orphanSubscription
+	unsubscribed map[string]struct{}
+	subscribing  int
+	subsMux      sync.Mutex
 }
 
 var typeOfPointToRPCConn = reflect.TypeOf((*WebsocketRPCConn)(nil))
@@ -48,16 +157,47 @@ var typeOfPointToRPCConn = reflect.TypeOf((*WebsocketRPCConn)(nil))
 // NewWebsocketRPC will create a websocket rpc object.
 func NewWebsocketRPC() *WebsocketRPC {
 	r := new(WebsocketRPC)
-	r.method = make(map[string]LowLevelRPCMethod)
+	r.method = make(map[string]LowLevelRPCMethodContext)
+	r.loginMethod = make(map[string]struct{})
+	r.ordering = make(map[string]OrderingKeyFunc)
+	r.workers = new(workerPool)
+	r.conns = make(map[*WebsocketRPCConn]struct{})
+	r.subscriptions = newSubscriptionRegistry()
 	return r
 }
 
-func (rpcConn *WebsocketRPCConn) allocRequestSeq(done chan *rpcMessage) json.RawMessage {
+// pendingCall is a call waiting for its response
+type pendingCall struct {
+	done chan struct{}
+	once sync.Once
+	msg  *rpcMessage
+	err  error
+}
+
+func newPendingCall() *pendingCall {
+	return &pendingCall{done: make(chan struct{})}
+}
+
+// resolve completes the call, only the first resolution takes effect
+func (p *pendingCall) resolve(msg *rpcMessage, err error) {
+	p.once.Do(func() {
+		p.msg = msg
+		p.err = err
+		close(p.done)
+	})
+}
+
+func (rpcConn *WebsocketRPCConn) allocRequestSeq(p *pendingCall) (uint64, json.RawMessage, error) {
 	seq := atomic.AddUint64(&rpcConn.seq, 1)
-	rpcConn.pending.Store(seq, done)
+	rpcConn.pending.Store(seq, p)
+	if rpcConn.ctx.Err() != nil {
+		// The connection has been closed, the call would never be resolved
+		rpcConn.pending.Delete(seq)
+		return 0, nil, ErrConnectionClosed
+	}
 	seqBytes, _ := json.Marshal(seq)
 	seqRaw := json.RawMessage(seqBytes)
-	return seqRaw
+	return seq, seqRaw, nil
 }
 
 // ToRPCError is a helper function to convert error to RPCErrorInfo.
@@ -74,6 +214,58 @@ func ToRPCError(err error) RPCErrorInfo {
 	return rpcErr
 }
 
+// requestKey returns a comparable key for a request ID
+func requestKey(id json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, id); err != nil {
+		return string(id)
+	}
+	return buf.String()
+}
+
+func (rpcConn *WebsocketRPCConn) processCancelRequest(params json.RawMessage) {
+	var p cancelRequestParams
+	if err := json.Unmarshal(params, &p); err != nil || p.ID == nil {
+		return
+	}
+	if cancel, ok := rpcConn.running.Load(requestKey(p.ID)); ok {
+		cancel.(context.CancelFunc)()
+	}
+}
+
+func (rpcConn *WebsocketRPCConn) sendCancelRequest(id json.RawMessage) {
+	if !rpcConn.RPC.EnableCancelRequest {
+		return
+	}
+	params, err := json.Marshal(cancelRequestParams{ID: id})
+	if err != nil {
+		return
+	}
+	_ = rpcConn.notifyLowLevel(CancelRequestMethod, params)
+}
+
+// callHandler calls the handler and converts a panic to RPCInternalError
+func (rpcConn *WebsocketRPCConn) callHandler(handler RPCHandler, req *RPCRequest, reply *json.RawMessage) (err error) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		stack := debug.Stack()
+		if rpcConn.RPC.PanicHandler != nil {
+			rpcConn.RPC.PanicHandler(req, recovered, stack)
+		}
+		rpcErr := RPCInternalError
+		if rpcConn.RPC.Debug {
+			rpcErr.Data = map[string]string{
+				"panic": fmt.Sprint(recovered),
+				"stack": string(stack)}
+		}
+		err = rpcErr
+	}()
+	return handler(req, reply)
+}
+
 func (rpcConn *WebsocketRPCConn) processRequest(msg rpcMessage) *rpcMessage {
 	if msg.Method == nil {
 		return &rpcMessage{
@@ -91,8 +283,33 @@ func (rpcConn *WebsocketRPCConn) processRequest(msg rpcMessage) *rpcMessage {
 			ID:      msg.ID,
 			Error:   &RPCMothedNotFoundError}
 	}
+	if rpcErr := rpcConn.authorize(*msg.Method); rpcErr != nil {
+		if msg.ID == nil {
+			return nil
+		}
+		return &rpcMessage{
+			JSONRPC: "2.0",
+			ID:      msg.ID,
+			Error:   rpcErr}
+	}
+	ctx, cancel := context.WithCancel(rpcConn.ctx)
+	defer cancel()
+	if msg.ID != nil {
+		key := requestKey(msg.ID)
+		rpcConn.running.Store(key, cancel)
+		defer rpcConn.running.Delete(key)
+	}
+	ctx = context.WithValue(ctx, streamContextKey{}, &RPCStream{rpcConn: rpcConn, id: msg.ID})
+	handler := rpcConn.RPC.applyMiddleware(*msg.Method, func(req *RPCRequest, reply *json.RawMessage) error {
+		return method(req.Context, req.Conn, req.Params, reply)
+	})
 	result := jsonNullValue
-	err := method(rpcConn, msg.Params, &result)
+	err := rpcConn.callHandler(handler, &RPCRequest{
+		Context: ctx,
+		Conn:    rpcConn,
+		Method:  *msg.Method,
+		ID:      msg.ID,
+		Params:  msg.Params}, &result)
 	if msg.ID == nil {
 		return nil
 	}
@@ -110,81 +327,227 @@ func (rpcConn *WebsocketRPCConn) processRequest(msg rpcMessage) *rpcMessage {
 }
 
 func (rpcConn *WebsocketRPCConn) processResponse(msg rpcMessage) {
-	if msg.ID != nil {
-		var seq uint64
-		err := json.Unmarshal(msg.ID, &seq)
-		if err == nil {
-			if done, ok := rpcConn.pending.Load(seq); ok {
-				rpcConn.pending.Delete(seq)
-				doneChan, _ := done.(chan *rpcMessage)
-				doneChan <- &msg
-			}
+	if msg.ID == nil || string(msg.ID) == "null" {
+		// An error without ID cannot be attributed to a call, it is likely that the peer rejects a whole batch.
+		// All the batches waiting for responses fail, as the peer responds to an accepted batch at once.
+		if msg.Error != nil {
+			rpcConn.batches.Range(func(key interface{}, _ interface{}) bool {
+				select {
+				case key.(chan *RPCErrorInfo) <- msg.Error:
+				default:
+				}
+				return true
+			})
+		}
+		return
+	}
+	var seq uint64
+	err := json.Unmarshal(msg.ID, &seq)
+	if err == nil {
+		if p, ok := rpcConn.pending.Load(seq); ok {
+			rpcConn.pending.Delete(seq)
+			p.(*pendingCall).resolve(&msg, nil)
 		}
 	}
 }
 
-func (rpcConn *WebsocketRPCConn) processMessage(rawMsg []byte) {
+// parseMessage parses a raw message and processes the responses, subscription, stream and cancel notifications in it.
+// It returns the requests, whether the message is a batch, and an error response if the message is invalid.
+func (rpcConn *WebsocketRPCConn) parseMessage(rawMsg []byte) ([]rpcMessage, bool, *rpcMessage) {
 	var msgs []rpcMessage
 	var err error
-	responseInArray := IsJSONArray(rawMsg)
-	if responseInArray {
+	inArray := IsJSONArray(rawMsg)
+	if inArray {
 		err = json.Unmarshal(rawMsg, &msgs)
 	} else {
 		msgs = make([]rpcMessage, 1)
 		err = json.Unmarshal(rawMsg, &msgs[0])
 	}
-	var responses []*rpcMessage
-	nResponse := 0
 	if err != nil {
-		responses = make([]*rpcMessage, 1)
-		nResponse = 1
-		responseInArray = false
-		responses[0] = &rpcMessage{
+		return nil, false, &rpcMessage{
 			JSONRPC: "2.0",
 			ID:      jsonNullValue,
 			Error:   &RPCParseError}
-	} else if len(msgs) == 0 {
-		responses = make([]*rpcMessage, 1)
-		nResponse = 1
-		responseInArray = false
-		responses[0] = &rpcMessage{
+	}
+	if len(msgs) == 0 || (rpcConn.RPC.MaxBatchSize > 0 && len(msgs) > rpcConn.RPC.MaxBatchSize) {
+		return nil, false, &rpcMessage{
 			JSONRPC: "2.0",
 			ID:      jsonNullValue,
 			Error:   &RPCInvalidRequestError}
-	} else {
-		responses = make([]*rpcMessage, len(msgs))
-		for _, msg := range msgs {
-			switch {
-			case msg.Result != nil || msg.Error != nil:
-				rpcConn.processResponse(msg)
-			default:
-				responses[nResponse] = rpcConn.processRequest(msg)
-				if responses[nResponse] != nil {
-					nResponse++
-				}
-			}
+	}
+	requests := make([]rpcMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		switch {
+		case msg.Result != nil || msg.Error != nil:
+			rpcConn.processResponse(msg)
+		case msg.ID == nil && msg.Method != nil && *msg.Method == SubscriptionMethod:
+			rpcConn.processSubscription(msg.Params)
+		case msg.ID == nil && msg.Method != nil && *msg.Method == StreamMethod:
+			rpcConn.processStream(msg.Params)
+		case msg.ID == nil && msg.Method != nil && *msg.Method == CancelRequestMethod && rpcConn.RPC.EnableCancelRequest:
+			// Cancel in the read loop, so that it is neither queued behind the request nor limited by workers
+			rpcConn.processCancelRequest(msg.Params)
+		default:
+			requests = append(requests, msg)
 		}
 	}
-	if nResponse == 0 {
-		return
+	return requests, inArray, nil
+}
+
+// encodeResponses returns nil if there is no response
+func encodeResponses(responses []*rpcMessage, inArray bool) []byte {
+	if len(responses) == 0 {
+		return nil
 	}
 	var resultBytes []byte
-	if responseInArray {
-		resultBytes, err = json.Marshal(responses[:nResponse])
+	var err error
+	if inArray {
+		resultBytes, err = json.Marshal(responses)
 	} else {
 		resultBytes, err = json.Marshal(responses[0])
 	}
 	if err != nil {
+		return nil
+	}
+	return resultBytes
+}
+
+func (rpcConn *WebsocketRPCConn) writeResponses(responses []*rpcMessage, inArray bool) {
+	if resultBytes := encodeResponses(responses, inArray); resultBytes != nil {
+		_ = rpcConn.adapter.WriteMessage(resultBytes)
+	}
+}
+
+// processMessage processes a message synchronously and returns the encoded responses (nil if there is none),
+// and whether the message is invalid.
+func (rpcConn *WebsocketRPCConn) processMessage(rawMsg []byte) ([]byte, *RPCErrorInfo) {
+	requests, inArray, errResponse := rpcConn.parseMessage(rawMsg)
+	if errResponse != nil {
+		return encodeResponses([]*rpcMessage{errResponse}, false), errResponse.Error
+	}
+	if len(requests) == 0 {
+		return nil, nil
+	}
+	if !rpcConn.acquireWorker() {
+		return encodeResponses(errorResponses(requests, &RPCServerBusyError), inArray), &RPCServerBusyError
+	}
+	defer rpcConn.releaseWorker()
+	return encodeResponses(rpcConn.processBatch(requests), inArray), nil
+}
+
+// dispatchMessage processes the responses in the message immediately,
+// and processes the requests in a new goroutine (or an ordered queue) if a worker is available.
+func (rpcConn *WebsocketRPCConn) dispatchMessage(rawMsg []byte) {
+	requests, inArray, errResponse := rpcConn.parseMessage(rawMsg)
+	if errResponse != nil {
+		rpcConn.writeResponses([]*rpcMessage{errResponse}, false)
+		return
+	}
+	if len(requests) == 0 {
+		return
+	}
+	if !rpcConn.startHandler() {
+		rpcConn.rejectRequests(requests, inArray, &RPCShuttingDownError)
+		return
+	}
+	if isPing(requests) {
+		// Answer heartbeats regardless of the ordering and concurrency limits,
+		// otherwise a busy but healthy connection would be closed by the peer
+		go func() {
+			defer rpcConn.handlers.Done()
+			rpcConn.writeResponses(rpcConn.processBatch(requests), inArray)
+		}()
+		return
+	}
+	key, ordered, err := rpcConn.orderingKey(requests)
+	if err != nil {
+		rpcConn.handlers.Done()
+		rpcConn.rejectRequests(requests, inArray, &RPCInvalidParamsError)
+		return
+	}
+	if !rpcConn.acquireWorker() {
+		rpcConn.handlers.Done()
+		rpcConn.rejectRequests(requests, inArray, &RPCServerBusyError)
 		return
 	}
-	_ = rpcConn.adapter.WriteMessage(resultBytes)
+	task := func() {
+		defer rpcConn.handlers.Done()
+		defer rpcConn.releaseWorker()
+		rpcConn.writeResponses(rpcConn.processBatch(requests), inArray)
+	}
+	if ordered {
+		rpcConn.enqueueOrdered(key, task)
+	} else {
+		go task()
+	}
+}
+
+// rejectRequests responds to the requests with the error
+func (rpcConn *WebsocketRPCConn) rejectRequests(requests []rpcMessage, inArray bool, rpcErr *RPCErrorInfo) {
+	rpcConn.writeResponses(errorResponses(requests, rpcErr), inArray)
+}
+
+// errorResponses returns the responses to the requests (notifications are skipped) with the error
+func errorResponses(requests []rpcMessage, rpcErr *RPCErrorInfo) []*rpcMessage {
+	responses := make([]*rpcMessage, 0, len(requests))
+	for _, msg := range requests {
+		if msg.ID != nil {
+			responses = append(responses, &rpcMessage{
+				JSONRPC: "2.0",
+				ID:      msg.ID,
+				Error:   rpcErr})
+		}
+	}
+	return responses
+}
+
+// processBatch processes the requests and returns the responses in the order of requests
+func (rpcConn *WebsocketRPCConn) processBatch(requests []rpcMessage) []*rpcMessage {
+	responses := make([]*rpcMessage, len(requests))
+	if rpcConn.RPC.BatchMode == BatchParallel && len(requests) > 1 {
+		var sem chan struct{}
+		if rpcConn.RPC.BatchConcurrency > 0 {
+			sem = make(chan struct{}, rpcConn.RPC.BatchConcurrency)
+		}
+		var wg sync.WaitGroup
+		for i := range requests {
+			if sem != nil {
+				sem <- struct{}{}
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				responses[i] = rpcConn.processRequest(requests[i])
+				if sem != nil {
+					<-sem
+				}
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range requests {
+			responses[i] = rpcConn.processRequest(requests[i])
+		}
+	}
+	nResponse := 0
+	for _, response := range responses {
+		if response != nil {
+			responses[nResponse] = response
+			nResponse++
+		}
+	}
+	return responses[:nResponse]
 }
 
 // MakeCall is used to make a proxy (as a normal function) to a remote procedure.
 // The format of params and result should be matched with inCodec and outCodec.
+//
+// The function can have a context.Context argument (optional, must be the first in argument)
+// to control the lifetime of the call. It is not passed to inCodec.
 func (rpcConn *WebsocketRPCConn) MakeCall(name string, fptr interface{}, inCodec RPCParamsCodec, outCodec RPCParamsCodec) {
 	fobj := reflect.ValueOf(fptr).Elem()
 	fType := fobj.Type()
+	inContext := fType.NumIn() > 0 && fType.In(0) == typeOfContext
 	outParamInfo := getAllOutParamInfo(fType)
 	nOut := len(outParamInfo)
 	hasErrInfo := false
@@ -211,12 +574,19 @@ func (rpcConn *WebsocketRPCConn) MakeCall(name string, fptr interface{}, inCodec
 	}
 	processorFunc := func(in []reflect.Value) []reflect.Value {
 		var err error
+		ctx := context.Background()
+		if inContext {
+			if c, ok := in[0].Interface().(context.Context); ok && c != nil {
+				ctx = c
+			}
+			in = in[1:]
+		}
 		argsRaw, err := inCodec.Encode(in)
 		if err != nil {
 			return makeErrorResult(err)
 		}
 		var replyRaw json.RawMessage
-		err = rpcConn.CallLowLevel(name, argsRaw, &replyRaw)
+		err = rpcConn.CallLowLevelContext(ctx, name, argsRaw, &replyRaw)
 		if err != nil {
 			return makeErrorResult(err)
 		}
@@ -237,13 +607,18 @@ func (rpcConn *WebsocketRPCConn) MakeCall(name string, fptr interface{}, inCodec
 // CallExplicitly provides a `net/rpc`-like way to call a remote procedure.
 // In this way, the struct is defined explicitly by the caller
 func (rpcConn *WebsocketRPCConn) CallExplicitly(name string, params interface{}, reply interface{}) error {
+	return rpcConn.CallExplicitlyContext(context.Background(), name, params, reply)
+}
+
+// CallExplicitlyContext is like CallExplicitly but the call is aborted when ctx is done.
+func (rpcConn *WebsocketRPCConn) CallExplicitlyContext(ctx context.Context, name string, params interface{}, reply interface{}) error {
 	paramBytes, err := json.Marshal(params)
 	if err != nil {
 		return err
 	}
 	rawParam := json.RawMessage(paramBytes)
 	var rawReply json.RawMessage
-	err = rpcConn.CallLowLevel(name, rawParam, &rawReply)
+	err = rpcConn.CallLowLevelContext(ctx, name, rawParam, &rawReply)
 	if err != nil {
 		return err
 	}
@@ -253,35 +628,96 @@ func (rpcConn *WebsocketRPCConn) CallExplicitly(name string, params interface{},
 
 // CallLowLevel is used to call a remote rrocedure in low-level way (use json.RawMessage).
 func (rpcConn *WebsocketRPCConn) CallLowLevel(name string, params json.RawMessage, reply *json.RawMessage) error {
+	return rpcConn.CallLowLevelContext(context.Background(), name, params, reply)
+}
+
+// CallLowLevelContext is like CallLowLevel but the call is aborted when ctx is done.
+// In that case, ctx.Err() is returned and the response (if any) is discarded.
+// Timeout is still applied if ctx has no earlier deadline.
+func (rpcConn *WebsocketRPCConn) CallLowLevelContext(ctx context.Context, name string, params json.RawMessage, reply *json.RawMessage) error {
+	var result json.RawMessage
+	err := rpcConn.applyInterceptors(rpcConn.invoke)(&RPCOutgoingRequest{
+		Context: ctx,
+		Conn:    rpcConn,
+		Method:  name,
+		Params:  params}, &result)
+	if err != nil {
+		return err
+	}
+	if reply != nil {
+		*reply = result
+	}
+	return nil
+}
+
+func (rpcConn *WebsocketRPCConn) callLowLevel(ctx context.Context, name string, params json.RawMessage, reply *json.RawMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	timer := time.NewTimer(rpcConn.Timeout)
+	defer timer.Stop()
+	for {
+		sent, err := rpcConn.callOnce(ctx, timer.C, name, params, reply)
+		if !rpcConn.retryable(name, err, sent) {
+			return err
+		}
+		if err = rpcConn.waitReconnect(ctx, timer.C); err != nil {
+			return err
+		}
+	}
+}
+
+// callOnce sends a request and waits for its response, it also reports whether the request is sent
+func (rpcConn *WebsocketRPCConn) callOnce(ctx context.Context, timeout <-chan time.Time, name string, params json.RawMessage, reply *json.RawMessage) (bool, error) {
 	msg := rpcMessage{
 		JSONRPC: "2.0",
 		Method:  &name,
 		Params:  params}
-	done := make(chan *rpcMessage, 1)
-	msg.ID = rpcConn.allocRequestSeq(done)
+	p := newPendingCall()
+	seq, id, err := rpcConn.allocRequestSeq(p)
+	if err != nil {
+		return false, err
+	}
+	msg.ID = id
+	if call, ok := ctx.Value(streamReceiverContextKey{}).(*RPCStreamCall); ok {
+		// Stream notifications are correlated by the request ID
+		key := requestKey(id)
+		rpcConn.streams.Store(key, call)
+		defer rpcConn.streams.Delete(key)
+	}
 	resultBytes, err := json.Marshal(msg)
 	if err != nil {
-		return err
+		rpcConn.pending.Delete(seq)
+		return false, err
 	}
 	err = rpcConn.adapter.WriteMessage(resultBytes)
 	if err != nil {
-		return err
+		rpcConn.pending.Delete(seq)
+		return false, err
 	}
 	var r *rpcMessage
-	timer := time.NewTimer(rpcConn.Timeout)
 	select {
-	case r = <-done:
-		timer.Stop()
-	case <-timer.C:
-		return errors.New("RPC call timed out")
+	case <-p.done:
+		if p.err != nil {
+			return true, p.err
+		}
+		r = p.msg
+	case <-timeout:
+		rpcConn.pending.Delete(seq)
+		rpcConn.sendCancelRequest(msg.ID)
+		return true, errCallTimeout
+	case <-ctx.Done():
+		rpcConn.pending.Delete(seq)
+		rpcConn.sendCancelRequest(msg.ID)
+		return true, ctx.Err()
 	}
 	if r.Error != nil {
-		return r.Error
+		return true, r.Error
 	}
 	if reply != nil {
 		*reply = r.Result
 	}
-	return nil
+	return true, nil
 }
 
 // MakeNotify is used to make a proxy (as a normal function) to send a notification.
@@ -344,6 +780,32 @@ func (rpcConn *WebsocketRPCConn) NotifyExplicitly(name string, params interface{
 
 // NotifyLowLevel is used to send a notification in low-level way (use json.RawMessage).
 func (rpcConn *WebsocketRPCConn) NotifyLowLevel(name string, params json.RawMessage) error {
+	return rpcConn.applyInterceptors(rpcConn.invoke)(&RPCOutgoingRequest{
+		Context:      context.Background(),
+		Conn:         rpcConn,
+		Method:       name,
+		Params:       params,
+		Notification: true}, nil)
+}
+
+// notifyContext sends a notification, it waits for the reconnection if the connection is lost
+func (rpcConn *WebsocketRPCConn) notifyContext(ctx context.Context, name string, params json.RawMessage) error {
+	err := rpcConn.notifyLowLevel(name, params)
+	if !rpcConn.retryable(name, err, false) {
+		return err
+	}
+	timer := time.NewTimer(rpcConn.Timeout)
+	defer timer.Stop()
+	for rpcConn.retryable(name, err, false) {
+		if err = rpcConn.waitReconnect(ctx, timer.C); err != nil {
+			return err
+		}
+		err = rpcConn.notifyLowLevel(name, params)
+	}
+	return err
+}
+
+func (rpcConn *WebsocketRPCConn) notifyLowLevel(name string, params json.RawMessage) error {
 	msg := rpcMessage{
 		JSONRPC: "2.0",
 		Method:  &name,
@@ -358,8 +820,13 @@ func (rpcConn *WebsocketRPCConn) NotifyLowLevel(name string, params json.RawMess
 
 // Register is used to register a normal function for RPC.
 //
-// The function can have a pointer argument to receive RPC connection object
+// The function can have a context.Context argument to receive the per-request context
 // (optional, must be the first in argument, do not provide name for this argument).
+// The function can have a pointer argument to receive RPC connection object
+// (optional, must be the first in argument or follow the context argument,
+// do not provide name for this argument).
+// The function can have a *RPCStream argument to send partial results and progress
+// (optional, must follow the special arguments above, do not provide name for this argument).
 // The function can also have an error return value. (optional, must be the last out argument,
 // do not provide name for this argument)
 //
@@ -381,23 +848,42 @@ func (rpc *WebsocketRPC) Register(name string, fobj interface{}, inCodec RPCPara
 		hasErrInfo = true
 		nOut--
 	}
+	inContext := false
+	if len(inParamInfo) > 0 && inParamInfo[0] == typeOfContext {
+		inContext = true
+		inParamInfo = inParamInfo[1:]
+	}
 	inThis := false
 	if len(inParamInfo) > 0 && inParamInfo[0] == typeOfPointToRPCConn {
 		inThis = true
 		inParamInfo = inParamInfo[1:]
 	}
-	fLowLevel := func(rpcConn *WebsocketRPCConn, rawArgs json.RawMessage, rawReply *json.RawMessage) error {
+	inStream := false
+	if len(inParamInfo) > 0 && inParamInfo[0] == typeOfPointToRPCStream {
+		inStream = true
+		inParamInfo = inParamInfo[1:]
+	}
+	fLowLevel := func(ctx context.Context, rpcConn *WebsocketRPCConn, rawArgs json.RawMessage, rawReply *json.RawMessage) error {
 		var err error
 		args, err := inCodec.Decode(rawArgs, inParamInfo)
 		if err != nil {
 			return RPCInvalidParamsError
 		}
-		var reply []reflect.Value
+		in := make([]reflect.Value, 0, len(args)+3)
+		if inContext {
+			in = append(in, reflect.ValueOf(&ctx).Elem())
+		}
 		if inThis {
-			reply = fValue.Call(append([]reflect.Value{reflect.ValueOf(rpcConn)}, args...))
-		} else {
-			reply = fValue.Call(args)
+			in = append(in, reflect.ValueOf(rpcConn))
+		}
+		if inStream {
+			stream := StreamFromContext(ctx)
+			if stream == nil {
+				stream = &RPCStream{rpcConn: rpcConn}
+			}
+			in = append(in, reflect.ValueOf(stream))
 		}
+		reply := fValue.Call(append(in, args...))
 		if hasErrInfo {
 			errorOut := reply[nOut].Interface()
 			if errorOut != nil {
@@ -408,7 +894,7 @@ func (rpc *WebsocketRPC) Register(name string, fobj interface{}, inCodec RPCPara
 		*rawReply, err = outCodec.Encode(reply)
 		return err
 	}
-	rpc.RegisterLowLevel(name, fLowLevel)
+	rpc.RegisterLowLevelContext(name, fLowLevel)
 }
 
 // RegisterExplicitly provides a `net/rpc`-like way to register a function.
@@ -417,6 +903,7 @@ func (rpc *WebsocketRPC) Register(name string, fobj interface{}, inCodec RPCPara
 // funcObj must have three in arguments. The first is a pointer to RPC connection,
 // the second is used to receive the params (can be a pointer or not),
 // and the third is used to send the result (must be a pointer).
+// A context.Context argument can be placed before them to receive the per-request context.
 // Moreover, the function can have no out parameters
 // or have one out parameter to return error info.
 func (rpc *WebsocketRPC) RegisterExplicitly(name string, fobj interface{}) error {
@@ -431,18 +918,23 @@ func (rpc *WebsocketRPC) RegisterExplicitly(name string, fobj interface{}) error
 	hasErrInfoOut := false
 	nIn := fType.NumIn()
 	nOut := fType.NumOut()
-	if nIn != 3 || nOut > 1 {
+	inContext := nIn == 4 && fType.In(0) == typeOfContext
+	offset := 0
+	if inContext {
+		offset = 1
+	}
+	if nIn != 3+offset || nOut > 1 {
 		return errors.New("cannot recognize the function")
 	}
-	if fType.In(0) != typeOfPointToRPCConn {
+	if fType.In(offset) != typeOfPointToRPCConn {
 		return errors.New("first in argument must be a pointer to a RPC connection")
 	}
-	argType := fType.In(1)
+	argType := fType.In(offset + 1)
 	argIsPtr := argType.Kind() == reflect.Ptr
 	if argIsPtr {
 		argType = argType.Elem()
 	}
-	replyType := fType.In(2)
+	replyType := fType.In(offset + 2)
 	if replyType.Kind() != reflect.Ptr {
 		return errors.New("reply argument must be a pointer")
 	}
@@ -453,7 +945,7 @@ func (rpc *WebsocketRPC) RegisterExplicitly(name string, fobj interface{}) error
 		}
 		hasErrInfoOut = true
 	}
-	fLowLevel := func(rpcConn *WebsocketRPCConn, rawArgs json.RawMessage, rawReply *json.RawMessage) error {
+	fLowLevel := func(ctx context.Context, rpcConn *WebsocketRPCConn, rawArgs json.RawMessage, rawReply *json.RawMessage) error {
 		var argv reflect.Value
 		var err error
 		argv = reflect.New(argType)
@@ -465,7 +957,11 @@ func (rpc *WebsocketRPC) RegisterExplicitly(name string, fobj interface{}) error
 			argv = argv.Elem()
 		}
 		replyv := reflect.New(replyType)
-		result := fValue.Call([]reflect.Value{reflect.ValueOf(rpcConn), argv, replyv})
+		in := []reflect.Value{reflect.ValueOf(rpcConn), argv, replyv}
+		if inContext {
+			in = append([]reflect.Value{reflect.ValueOf(&ctx).Elem()}, in...)
+		}
+		result := fValue.Call(in)
 		if hasErrInfoOut {
 			targetErr := result[0].Interface()
 			if targetErr != nil {
@@ -479,12 +975,22 @@ func (rpc *WebsocketRPC) RegisterExplicitly(name string, fobj interface{}) error
 		*rawReply = rawReplyBytes
 		return nil
 	}
-	rpc.RegisterLowLevel(name, fLowLevel)
+	rpc.RegisterLowLevelContext(name, fLowLevel)
 	return nil
 }
 
 // RegisterLowLevel is used to register a normal function for RPC in low-level way (use json.RawMessage).
 func (rpc *WebsocketRPC) RegisterLowLevel(name string, method LowLevelRPCMethod) {
+	if method == nil {
+		return
+	}
+	rpc.method[name] = func(_ context.Context, rpcConn *WebsocketRPCConn, arg json.RawMessage, reply *json.RawMessage) error {
+		return method(rpcConn, arg, reply)
+	}
+}
+
+// RegisterLowLevelContext is like RegisterLowLevel but the method receives a per-request context.
+func (rpc *WebsocketRPC) RegisterLowLevelContext(name string, method LowLevelRPCMethodContext) {
 	if method == nil {
 		return
 	}
@@ -492,40 +998,168 @@ func (rpc *WebsocketRPC) RegisterLowLevel(name string, method LowLevelRPCMethod)
 }
 
 // Connect is a function to create a rpc connection binded to a websocket connection.
-func (rpc *WebsocketRPC) Connect(conn *websocket.Conn) *WebsocketRPCConn {
-	return rpc.ConnectAdapter(NewWebsocketMessageAdapter(conn))
+func (rpc *WebsocketRPC) Connect(conn *websocket.Conn, opts ...ConnectOption) *WebsocketRPCConn {
+	return rpc.ConnectAdapter(NewWebsocketMessageAdapter(conn), opts...)
 }
 
 // ConnectAdapter is a function to create a rpc connection binded to an adapter.
-func (rpc *WebsocketRPC) ConnectAdapter(adapter MessageAdapter) *WebsocketRPCConn {
+func (rpc *WebsocketRPC) ConnectAdapter(adapter MessageAdapter, opts ...ConnectOption) *WebsocketRPCConn {
+	r := rpc.newConn(context.Background(), adapter, opts...)
+	rpc.trackConn(r)
+	return r
+}
+
+// newConn creates a connection which is not tracked, its context is derived from ctx
+func (rpc *WebsocketRPC) newConn(ctx context.Context, adapter MessageAdapter, opts ...ConnectOption) *WebsocketRPCConn {
 	r := WebsocketRPCConn{
-		RPC:     rpc,
-		adapter: adapter,
-		Timeout: 10 * time.Second,
-		Session: make(map[string]interface{})}
+		RPC:          rpc,
+		adapter:      adapter,
+		Timeout:      10 * time.Second,
+		Session:      newRPCSession(),
+		workers:      new(workerPool),
+		queues:       make(map[string]*orderedQueue),
+		done:         make(chan struct{}),
+		subs:         make(map[string]*RPCSubscription),
+		orphans:      make(map[string]*orphanSubscription),
+		unsubscribed: make(map[string]struct{})}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	for _, opt := range opts {
+		opt(&r)
+	}
 	return &r
 }
 
 // ServeConn is a function that you should call it at last to receive messages continuously.
 // It will block until the connection is closed.
 func (rpcConn *WebsocketRPCConn) ServeConn() {
+	rpcConn.RPC.initWorkers()
+	if rpcConn.MaxConcurrency > 0 {
+		rpcConn.workers.sem = make(chan struct{}, rpcConn.MaxConcurrency)
+	}
+	// OnConnect and OnDisconnect are paired, neither is called if the connection is closed before serving
+	rpcConn.closeMux.Lock()
+	rpcConn.serving = !rpcConn.finished
+	serving := rpcConn.serving
+	rpcConn.closeMux.Unlock()
+	if serving && rpcConn.RPC.OnConnect != nil {
+		rpcConn.RPC.OnConnect(rpcConn)
+	}
+	var err error
 	for {
-		message, err := rpcConn.adapter.ReadMessage()
+		var message []byte
+		message, err = rpcConn.adapter.ReadMessage()
 		if err != nil {
 			break
 		}
-		go func() {
-			rpcConn.processMessage(message)
-		}()
+		rpcConn.dispatchMessage(message)
 	}
-	// Handle all pending request
+	rpcConn.finish(err)
+}
+
+// finish cancels all running requests, fails all pending calls and reports the reason
+func (rpcConn *WebsocketRPCConn) finish(reason error) {
+	finished, serving := false, false
+	rpcConn.finishOnce.Do(func() {
+		rpcConn.closeMux.Lock()
+		rpcConn.closing = true
+		rpcConn.finished = true
+		rpcConn.err = reason
+		serving = rpcConn.serving
+		rpcConn.closeMux.Unlock()
+		rpcConn.cancel()
+		rpcConn.failPending(ErrConnectionClosed)
+		close(rpcConn.done)
+		finished = true
+	})
+	if !finished {
+		return
+	}
+	// Clean up and report out of finishOnce, so that OnDisconnect can call Close
+	rpcConn.RPC.untrackConn(rpcConn)
+	rpcConn.RPC.subscriptions.removeConn(rpcConn)
+	rpcConn.closeSubscriptions()
+	if serving && rpcConn.RPC.OnDisconnect != nil {
+		rpcConn.RPC.OnDisconnect(rpcConn, reason)
+	}
+}
+
+// failPending fails all pending calls with err
+func (rpcConn *WebsocketRPCConn) failPending(err error) {
 	rpcConn.pending.Range(func(key interface{}, value interface{}) bool {
 		rpcConn.pending.Delete(key)
-		done, _ := value.(chan *rpcMessage)
-		done <- &rpcMessage{
-			JSONRPC: "2.0",
-			ID:      jsonNullValue,
-			Error:   &RPCInternalError}
+		value.(*pendingCall).resolve(nil, err)
 		return true
 	})
 }
+
+// Done returns a channel that is closed when the connection is closed.
+func (rpcConn *WebsocketRPCConn) Done() <-chan struct{} {
+	return rpcConn.done
+}
+
+// Err returns nil if Done is not yet closed.
+// Otherwise, it returns ErrConnectionClosed if the connection is closed explicitly,
+// or the error returned by the adapter (eg. *websocket.CloseError, which has the close code).
+func (rpcConn *WebsocketRPCConn) Err() error {
+	rpcConn.closeMux.Lock()
+	defer rpcConn.closeMux.Unlock()
+	return rpcConn.err
+}
+
+func (rpcConn *WebsocketRPCConn) setClosing() {
+	rpcConn.closeMux.Lock()
+	rpcConn.closing = true
+	rpcConn.closeMux.Unlock()
+}
+
+// startHandler registers a running handler, returns false if the connection is closing
+func (rpcConn *WebsocketRPCConn) startHandler() bool {
+	rpcConn.closeMux.Lock()
+	defer rpcConn.closeMux.Unlock()
+	if rpcConn.closing {
+		return false
+	}
+	rpcConn.handlers.Add(1)
+	return true
+}
+
+// Close closes the connection immediately.
+// Pending calls fail with ErrConnectionClosed, the contexts of running requests are cancelled,
+// and the adapter is closed if it implements io.Closer.
+func (rpcConn *WebsocketRPCConn) Close() error {
+	return rpcConn.closeWithError(ErrConnectionClosed)
+}
+
+// closeWithError is like Close but reason is reported by Err
+func (rpcConn *WebsocketRPCConn) closeWithError(reason error) error {
+	rpcConn.finish(reason)
+	var err error
+	rpcConn.closeOnce.Do(func() {
+		if closer, ok := rpcConn.adapter.(io.Closer); ok {
+			err = closer.Close()
+		}
+	})
+	return err
+}
+
+// Shutdown closes the connection gracefully.
+// It stops accepting new requests (RPCShuttingDownError is sent instead),
+// waits for running handlers to finish or ctx to be done, and then closes the connection.
+func (rpcConn *WebsocketRPCConn) Shutdown(ctx context.Context) error {
+	rpcConn.setClosing()
+	idle := make(chan struct{})
+	go func() {
+		rpcConn.handlers.Wait()
+		close(idle)
+	}()
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if closeErr := rpcConn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package wsrpc
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// JSONRPCSubprotocol is the websocket subprotocol name of JSON-RPC 2.0.
+const JSONRPCSubprotocol = "jsonrpc-2.0"
+
+// WebsocketRPCHandler is an http.Handler that upgrades requests to websocket and serves the RPC service on them.
+// The HandshakeAuthenticator of the RPC service is applied before upgrading,
+// and the request is rejected with status 401 if it fails.
+type WebsocketRPCHandler struct {
+	//RPC is a pointer to the RPC service
+	RPC *WebsocketRPC
+	//CheckOrigin returns true if the Origin header of the request is acceptable.
+	//If it is nil, only same-origin requests (or those without Origin header) are accepted.
+	CheckOrigin func(r *http.Request) bool
+	//Subprotocols lists the supported subprotocols in order of preference, default is JSONRPCSubprotocol.
+	Subprotocols []string
+	//RequireSubprotocol rejects the request with status 400 if none of Subprotocols is requested by the client.
+	RequireSubprotocol bool
+	//InitSession is called before serving a connection to initialize it with the HTTP request,
+	//the connection is closed if it returns an error.
+	InitSession func(rpcConn *WebsocketRPCConn, r *http.Request) error
+	//ReadLimit limits the size in bytes of a message read from the peer, 0 means unlimited.
+	//The connection is closed if the limit is exceeded.
+	ReadLimit int64
+	//EnableCompression enables the per message compression (RFC 7692) if the client supports it.
+	EnableCompression bool
+	//ReadBufferSize and WriteBufferSize set the I/O buffer sizes in bytes, 0 means the default size.
+	ReadBufferSize, WriteBufferSize int
+	//PingInterval enables the websocket ping/pong keepalive, see WebsocketMessageAdapter.SetKeepalive.
+	PingInterval time.Duration
+	//PongTimeout is the time to wait for a pong after PingInterval, default is 10 seconds.
+	PongTimeout time.Duration
+}
+
+// Handler creates an http.Handler which serves the RPC service, eg. `http.Handle("/rpc", rpc.Handler())`.
+// The returned handler can be customized before serving.
+func (rpc *WebsocketRPC) Handler() *WebsocketRPCHandler {
+	return &WebsocketRPCHandler{
+		RPC:          rpc,
+		Subprotocols: []string{JSONRPCSubprotocol}}
+}
+
+func (h *WebsocketRPCHandler) negotiated(r *http.Request) bool {
+	requested := websocket.Subprotocols(r)
+	for _, supported := range h.Subprotocols {
+		for _, p := range requested {
+			if p == supported {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ServeHTTP upgrades the request and serves the connection until it is closed.
+func (h *WebsocketRPCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.RequireSubprotocol && !h.negotiated(r) {
+		http.Error(w, "unsupported subprotocol", http.StatusBadRequest)
+		return
+	}
+	principal, err := h.RPC.AuthenticateRequest(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:    h.ReadBufferSize,
+		WriteBufferSize:   h.WriteBufferSize,
+		Subprotocols:      h.Subprotocols,
+		CheckOrigin:       h.CheckOrigin,
+		EnableCompression: h.EnableCompression}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has replied with an HTTP error
+		return
+	}
+	adapter := NewWebsocketMessageAdapter(conn)
+	defer adapter.Close()
+	if h.ReadLimit > 0 {
+		conn.SetReadLimit(h.ReadLimit)
+	}
+	if h.PingInterval > 0 {
+		timeout := h.PongTimeout
+		if timeout <= 0 {
+			timeout = 10 * time.Second
+		}
+		adapter.SetKeepalive(h.PingInterval, timeout)
+	}
+	rpcConn := h.RPC.ConnectAdapter(adapter, WithPrincipal(principal))
+	if h.InitSession != nil {
+		if err := h.InitSession(rpcConn, r); err != nil {
+			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+			_ = rpcConn.Close()
+			return
+		}
+	}
+	rpcConn.ServeConn()
+}
@@ -1,9 +1,21 @@
 package wsrpc_test
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,7 +30,7 @@ var upgrader = websocket.Upgrader{
 }
 
 var rpcServer *wsrpc.WebsocketRPC
-var receivedNotification bool = false
+var receivedNotification int32 = 0
 
 type addArgs struct {
 	A int `json:"a"`
@@ -29,7 +41,7 @@ type addReply struct {
 }
 
 func rpcMethodReceiveNotification() {
-	receivedNotification = true
+	atomic.StoreInt32(&receivedNotification, 1)
 }
 
 func rpcMethodAdd(a int, b int) int {
@@ -37,7 +49,7 @@ func rpcMethodAdd(a int, b int) int {
 }
 
 func rpcMethodHello(rpcConn *wsrpc.WebsocketRPCConn, name string) (string, string, error) {
-	v, ok := rpcConn.Session["foo"].(string)
+	v, ok := rpcConn.Session.GetString("foo")
 	if !ok {
 		return "", "", errors.New("internal error")
 	}
@@ -57,15 +69,73 @@ func rpcMethodWelcome(_ *wsrpc.WebsocketRPCConn, args welcomeArgs, reply *welcom
 	return nil
 }
 
+func rpcMethodSleep(ms int) {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+}
+
 func newRPCServer() *wsrpc.WebsocketRPC {
 	rpcServer := wsrpc.NewWebsocketRPC()
 	rpcServer.Register("add", rpcMethodAdd, wsrpc.NewRPCNamedParamsCodec([]string{"a", "b"}), wsrpc.NewRPCNamedParamsCodec([]string{"result"}))
 	rpcServer.Register("hello", rpcMethodHello, wsrpc.NewRPCMixedParamsCodec([]string{"name"}), wsrpc.NewRPCPositionalParamsCodec())
 	rpcServer.Register("receive_notification", rpcMethodReceiveNotification, wsrpc.NewRPCOriginalParamsCodec(), wsrpc.NewRPCOriginalParamsCodec())
 	rpcServer.RegisterExplicitly("welcome", rpcMethodWelcome)
+	rpcServer.Register("sleep", rpcMethodSleep, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
 	return rpcServer
 }
 
+// newTestConn serves server on a temporary HTTP server and returns a connected client
+func newTestConn(t *testing.T, server *wsrpc.WebsocketRPC, client *wsrpc.WebsocketRPC) *wsrpc.WebsocketRPCConn {
+	_, rpcConn := newTestConnPair(t, server, client)
+	return rpcConn
+}
+
+// newTestConnPair is like newTestConn but also returns the connection on the server side
+func newTestConnPair(t *testing.T, server *wsrpc.WebsocketRPC, client *wsrpc.WebsocketRPC) (*wsrpc.WebsocketRPCConn, *wsrpc.WebsocketRPCConn) {
+	serverConn := make(chan *wsrpc.WebsocketRPCConn, 1)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		c, err := upgrader.Upgrade(writer, request, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		rpcConn := server.Connect(c, wsrpc.WithSessionValue("foo", "Hello"))
+		serverConn <- rpcConn
+		rpcConn.ServeConn()
+	}))
+	t.Cleanup(httpServer.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	rpcConn := client.Connect(conn)
+	go rpcConn.ServeConn()
+	return <-serverConn, rpcConn
+}
+
+func TestCallContext(t *testing.T) {
+	rpcConn := newTestConn(t, newRPCServer(), wsrpc.NewWebsocketRPC())
+	var sleep func(ctx context.Context, ms int) error
+	rpcConn.MakeCall("sleep", &sleep, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := sleep(ctx, 2000)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded but got %v", err)
+	}
+	err = sleep(context.Background(), 10)
+	if err != nil {
+		t.Error(err)
+	}
+	canceled, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+	var addResult addReply
+	err = rpcConn.CallExplicitlyContext(canceled, "add", addArgs{A: 1, B: 2}, &addResult)
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled but got %v", err)
+	}
+}
+
 func TestWebsocketRPC(t *testing.T) {
 	go func() {
 		rpcServer = newRPCServer()
@@ -119,7 +189,7 @@ func TestWebsocketRPC(t *testing.T) {
 	notify()
 	//Wait for the server receiving
 	time.Sleep(time.Duration(2) * time.Second)
-	if !receivedNotification {
+	if atomic.LoadInt32(&receivedNotification) == 0 {
 		t.Error("the server failed to receive the notification")
 	}
 }
@@ -131,6 +201,1480 @@ func wsHandler(writer http.ResponseWriter, request *http.Request) {
 	}
 	defer c.Close()
 	rpcConn := rpcServer.Connect(c)
-	rpcConn.Session["foo"] = "Hello"
+	rpcConn.Session.Set("foo", "Hello")
+	rpcConn.ServeConn()
+}
+
+func TestCancelRequest(t *testing.T) {
+	server := newRPCServer()
+	server.EnableCancelRequest = true
+	cancelled := make(chan struct{})
+	server.Register("wait", func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			close(cancelled)
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	client := wsrpc.NewWebsocketRPC()
+	client.EnableCancelRequest = true
+	rpcConn := newTestConn(t, server, client)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := rpcConn.CallLowLevelContext(ctx, "wait", nil, nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded but got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Error("the server failed to cancel the request")
+	}
+}
+
+func TestSequentialControl(t *testing.T) {
+	server := wsrpc.NewWebsocketRPC()
+	server.EnableCancelRequest = true
+	server.EnablePing()
+	cancelled := make(chan struct{}, 1)
+	server.Register("wait", func(ctx context.Context) error {
+		<-ctx.Done()
+		cancelled <- struct{}{}
+		return ctx.Err()
+	}, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	client := wsrpc.NewWebsocketRPC()
+	client.EnableCancelRequest = true
+	a, b := wsrpc.NewPipe()
+	serverConn := server.ConnectAdapter(a)
+	serverConn.Sequential = true
+	serverConn.MaxConcurrency = 1
+	go serverConn.ServeConn()
+	rpcConn := client.ConnectAdapter(b)
+	go rpcConn.ServeConn()
+	t.Cleanup(func() {
+		_ = rpcConn.Close()
+	})
+	done := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		done <- rpcConn.CallLowLevelContext(ctx, "wait", nil, nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// Ping is answered although the only worker is busy
+	pingCtx, pingCancel := context.WithTimeout(context.Background(), time.Second)
+	defer pingCancel()
+	if err := rpcConn.CallLowLevelContext(pingCtx, wsrpc.PingMethod, nil, nil); err != nil {
+		t.Errorf("expected pong but got %v", err)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected context.Canceled but got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Error("the sequential server failed to cancel the running request")
+	}
+}
+
+type mathService struct{}
+
+func (mathService) Add(a int, b int) int {
+	return a + b
+}
+
+func (mathService) Welcome(rpcConn *wsrpc.WebsocketRPCConn, args welcomeArgs, reply *welcomeReply) error {
+	return rpcMethodWelcome(rpcConn, args, reply)
+}
+
+func (mathService) Scale(rpcConn *wsrpc.WebsocketRPCConn, a int, b int) int {
+	return a * b
+}
+
+func (mathService) Watch(ch chan int) {}
+
+func (*mathService) Reset() {}
+
+func TestRegisterService(t *testing.T) {
+	server := wsrpc.NewWebsocketRPC()
+	skipped, err := server.RegisterService("math", mathService{}, wsrpc.WithServiceNameTransform(wsrpc.LowerCamelCase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 2 {
+		t.Errorf("expected 2 skipped methods but got %v", skipped)
+	}
+	rpcConn := newTestConn(t, server, wsrpc.NewWebsocketRPC())
+	var add func(a int, b int) (int, error)
+	rpcConn.MakeCall("math.add", &add, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	sum, err := add(1, 2)
+	if err != nil {
+		t.Error(err)
+	}
+	if sum != 3 {
+		t.Error("expected 3 but got " + fmt.Sprint(sum))
+	}
+	var welcomeResult welcomeReply
+	err = rpcConn.CallExplicitly("math.welcome", welcomeArgs{Name: "wsrpc"}, &welcomeResult)
+	if err != nil {
+		t.Error(err)
+	}
+	if welcomeResult.Message != "Welcome, wsrpc" {
+		t.Error("expected \"Welcome, wsrpc\" but got \"" + welcomeResult.Message + "\"")
+	}
+	var scale func(a int, b int) (int, error)
+	rpcConn.MakeCall("math.scale", &scale, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	if product, err := scale(3, 4); err != nil || product != 12 {
+		t.Errorf("expected 12 but got %v (%v)", product, err)
+	}
+	if wsrpc.SnakeCase("GetHTTPServer") != "get_http_server" {
+		t.Error("unexpected snake case: " + wsrpc.SnakeCase("GetHTTPServer"))
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	server := newRPCServer()
+	var calls []string
+	server.Use(func(next wsrpc.RPCHandler) wsrpc.RPCHandler {
+		return func(req *wsrpc.RPCRequest, reply *json.RawMessage) error {
+			calls = append(calls, req.Method)
+			return next(req, reply)
+		}
+	})
+	forbidden := wsrpc.RPCErrorInfo{Code: 1, Message: "Forbidden"}
+	err := server.UseFor("we*", func(next wsrpc.RPCHandler) wsrpc.RPCHandler {
+		return func(req *wsrpc.RPCRequest, reply *json.RawMessage) error {
+			return forbidden
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcConn := newTestConn(t, server, wsrpc.NewWebsocketRPC())
+	var addResult addReply
+	err = rpcConn.CallExplicitly("add", addArgs{A: 1, B: 2}, &addResult)
+	if err != nil {
+		t.Error(err)
+	}
+	var welcomeResult welcomeReply
+	err = rpcConn.CallExplicitly("welcome", welcomeArgs{Name: "wsrpc"}, &welcomeResult)
+	if rpcErr, ok := err.(*wsrpc.RPCErrorInfo); !ok || rpcErr.Code != forbidden.Code {
+		t.Errorf("expected %v but got %v", forbidden, err)
+	}
+	if strings.Join(calls, ",") != "add,welcome" {
+		t.Error("unexpected calls: " + strings.Join(calls, ","))
+	}
+}
+
+func TestInterceptor(t *testing.T) {
+	client := wsrpc.NewWebsocketRPC()
+	var methods []string
+	client.Intercept(func(next wsrpc.RPCInvoker) wsrpc.RPCInvoker {
+		return func(req *wsrpc.RPCOutgoingRequest, reply *json.RawMessage) error {
+			methods = append(methods, req.Method)
+			return next(req, reply)
+		}
+	})
+	rpcConn := newTestConn(t, newRPCServer(), client)
+	rpcConn.Intercept(func(next wsrpc.RPCInvoker) wsrpc.RPCInvoker {
+		return func(req *wsrpc.RPCOutgoingRequest, reply *json.RawMessage) error {
+			if req.Method == "add" {
+				req.Params = json.RawMessage(`{"a":40,"b":2}`)
+			}
+			return next(req, reply)
+		}
+	})
+	var add func(a int, b int) int
+	rpcConn.MakeCall("add", &add, wsrpc.NewRPCNamedParamsCodec([]string{"a", "b"}), wsrpc.NewRPCNamedParamsCodec([]string{"result"}))
+	if sum := add(1, 2); sum != 42 {
+		t.Error("expected 42 but got " + fmt.Sprint(sum))
+	}
+	var notify func()
+	rpcConn.MakeNotify("receive_notification", &notify, wsrpc.NewRPCOriginalParamsCodec())
+	notify()
+	if strings.Join(methods, ",") != "add,receive_notification" {
+		t.Error("unexpected methods: " + strings.Join(methods, ","))
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	server := newRPCServer()
+	server.Debug = true
+	reported := make(chan interface{}, 1)
+	server.PanicHandler = func(req *wsrpc.RPCRequest, recovered interface{}, stack []byte) {
+		reported <- recovered
+	}
+	server.Register("panic", func() {
+		panic("boom")
+	}, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	rpcConn := newTestConn(t, server, wsrpc.NewWebsocketRPC())
+	err := rpcConn.CallLowLevel("panic", nil, nil)
+	rpcErr, ok := err.(*wsrpc.RPCErrorInfo)
+	if !ok || rpcErr.Code != wsrpc.RPCInternalError.Code || rpcErr.Data == nil {
+		t.Errorf("expected an internal error with data but got %v", err)
+	}
+	select {
+	case recovered := <-reported:
+		if recovered != "boom" {
+			t.Errorf("expected \"boom\" but got %v", recovered)
+		}
+	case <-time.After(time.Second):
+		t.Error("the panic was not reported")
+	}
+	var addResult addReply
+	err = rpcConn.CallExplicitly("add", addArgs{A: 1, B: 2}, &addResult)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	rpcConn := newTestConn(t, newRPCServer(), wsrpc.NewWebsocketRPC())
+	batch := rpcConn.NewBatch()
+	var addResult addReply
+	explicitCall := batch.CallExplicitly("add", addArgs{A: 1, B: 2}, &addResult)
+	var helloA, helloB string
+	typedCall := batch.Call("hello", wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec(), []interface{}{"wsrpc"}, &helloA, &helloB)
+	rawCall := batch.CallLowLevel("not_found", nil)
+	batch.NotifyLowLevel("receive_notification", nil)
+	err := batch.Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if explicitCall.Error != nil || addResult.Result != 3 {
+		t.Errorf("expected 3 but got %v (%v)", addResult.Result, explicitCall.Error)
+	}
+	if typedCall.Error != nil || helloA != "Hello" || helloB != "wsrpc" {
+		t.Errorf("expected \"Hello\", \"wsrpc\" but got %q, %q (%v)", helloA, helloB, typedCall.Error)
+	}
+	if rpcErr, ok := rawCall.Error.(*wsrpc.RPCErrorInfo); !ok || rpcErr.Code != wsrpc.RPCMothedNotFoundError.Code {
+		t.Errorf("expected %v but got %v", wsrpc.RPCMothedNotFoundError, rawCall.Error)
+	}
+}
+
+func TestBatchRejected(t *testing.T) {
+	server := newRPCServer()
+	server.MaxBatchSize = 2
+	rpcConn := newTestConn(t, server, wsrpc.NewWebsocketRPC())
+	rpcConn.Timeout = 10 * time.Second
+	batch := rpcConn.NewBatch()
+	calls := make([]*wsrpc.RPCBatchCall, 3)
+	for i := range calls {
+		calls[i] = batch.CallLowLevel("hello", json.RawMessage(`["wsrpc"]`))
+	}
+	start := time.Now()
+	err := batch.Send()
+	if rpcErr, ok := err.(*wsrpc.RPCErrorInfo); !ok || rpcErr.Code != wsrpc.RPCInvalidRequestError.Code {
+		t.Errorf("expected %v but got %v", wsrpc.RPCInvalidRequestError, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the batch to fail immediately but it took %v", elapsed)
+	}
+	for _, call := range calls {
+		if call.Error != err {
+			t.Errorf("expected the error of the batch but got %v", call.Error)
+		}
+	}
+}
+
+func TestBatchSerializingInterceptor(t *testing.T) {
+	rpcConn := newTestConn(t, newRPCServer(), wsrpc.NewWebsocketRPC())
+	rpcConn.Timeout = 200 * time.Millisecond
+	var mux sync.Mutex
+	rpcConn.Intercept(func(next wsrpc.RPCInvoker) wsrpc.RPCInvoker {
+		return func(req *wsrpc.RPCOutgoingRequest, reply *json.RawMessage) error {
+			mux.Lock()
+			defer mux.Unlock()
+			return next(req, reply)
+		}
+	})
+	batch := rpcConn.NewBatch()
+	calls := []*wsrpc.RPCBatchCall{
+		batch.CallLowLevel("hello", json.RawMessage(`["a"]`)),
+		batch.CallLowLevel("hello", json.RawMessage(`["b"]`)),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := batch.SendContext(ctx); err == nil {
+		t.Error("expected the batch to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the batch to fail after Timeout but it took %v", elapsed)
+	}
+	for _, call := range calls {
+		if call.Error == nil {
+			t.Error("expected each call to fail")
+		}
+	}
+}
+
+func TestBatchInterceptor(t *testing.T) {
+	rpcConn := newTestConn(t, newRPCServer(), wsrpc.NewWebsocketRPC())
+	var mux sync.Mutex
+	var methods []string
+	rpcConn.Intercept(func(next wsrpc.RPCInvoker) wsrpc.RPCInvoker {
+		return func(req *wsrpc.RPCOutgoingRequest, reply *json.RawMessage) error {
+			mux.Lock()
+			methods = append(methods, req.Method)
+			mux.Unlock()
+			switch req.Method {
+			case "add":
+				req.Params = json.RawMessage(`{"a":40,"b":2}`)
+			case "cached":
+				*reply = json.RawMessage(`{"result":7}`)
+				return nil
+			}
+			return next(req, reply)
+		}
+	})
+	batch := rpcConn.NewBatch()
+	var addResult, cachedResult addReply
+	addCall := batch.CallExplicitly("add", addArgs{A: 1, B: 2}, &addResult)
+	cachedCall := batch.CallExplicitly("cached", nil, &cachedResult)
+	batch.NotifyLowLevel("receive_notification", nil)
+	if err := batch.Send(); err != nil {
+		t.Fatal(err)
+	}
+	if addCall.Error != nil || addResult.Result != 42 {
+		t.Errorf("expected 42 but got %v (%v)", addResult.Result, addCall.Error)
+	}
+	if cachedCall.Error != nil || cachedResult.Result != 7 {
+		t.Errorf("expected 7 but got %v (%v)", cachedResult.Result, cachedCall.Error)
+	}
+	if len(methods) != 3 {
+		t.Errorf("expected 3 intercepted requests but got %v", methods)
+	}
+}
+
+func TestParallelBatch(t *testing.T) {
+	server := newRPCServer()
+	server.BatchMode = wsrpc.BatchParallel
+	server.BatchConcurrency = 4
+	rpcConn := newTestConn(t, server, wsrpc.NewWebsocketRPC())
+	batch := rpcConn.NewBatch()
+	calls := make([]*wsrpc.RPCBatchCall, 8)
+	for i := range calls {
+		calls[i] = batch.CallLowLevel("sleep", json.RawMessage("[200]"))
+	}
+	start := time.Now()
+	err := batch.Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the batch to run in parallel but it took %v", elapsed)
+	}
+	for _, call := range calls {
+		if call.Error != nil {
+			t.Error(call.Error)
+		}
+	}
+}
+
+func TestOverloadReject(t *testing.T) {
+	server := newRPCServer()
+	server.MaxConcurrency = 1
+	server.OverloadPolicy = wsrpc.OverloadReject
+	rpcConn := newTestConn(t, server, wsrpc.NewWebsocketRPC())
+	done := make(chan error, 1)
+	go func() {
+		done <- rpcConn.CallLowLevel("sleep", json.RawMessage("[500]"), nil)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if running := server.Stats().Running; running != 1 {
+		t.Errorf("expected 1 running message but got %v", running)
+	}
+	var addResult addReply
+	err := rpcConn.CallExplicitly("add", addArgs{A: 1, B: 2}, &addResult)
+	if rpcErr, ok := err.(*wsrpc.RPCErrorInfo); !ok || rpcErr.Code != wsrpc.RPCServerBusyError.Code {
+		t.Errorf("expected %v but got %v", wsrpc.RPCServerBusyError, err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if rejected := server.Stats().Rejected; rejected != 1 {
+		t.Errorf("expected 1 rejected message but got %v", rejected)
+	}
+}
+
+type documentEdit struct {
+	Doc   string `json:"doc"`
+	Value int    `json:"value"`
+}
+
+func TestOrder(t *testing.T) {
+	server := wsrpc.NewWebsocketRPC()
+	var mux sync.Mutex
+	docs := make(map[string][]int)
+	server.RegisterExplicitly("append", func(_ *wsrpc.WebsocketRPCConn, args documentEdit, _ *struct{}) {
+		time.Sleep(time.Duration(5-args.Value%5) * time.Millisecond)
+		mux.Lock()
+		defer mux.Unlock()
+		docs[args.Doc] = append(docs[args.Doc], args.Value)
+	})
+	server.RegisterExplicitly("commit", func(_ *wsrpc.WebsocketRPCConn, args documentEdit, reply *[]int) {
+		mux.Lock()
+		defer mux.Unlock()
+		*reply = docs[args.Doc]
+	})
+	byDoc := func(params json.RawMessage) string {
+		var edit documentEdit
+		_ = json.Unmarshal(params, &edit)
+		return edit.Doc
+	}
+	server.Order("append", byDoc)
+	server.Order("commit", byDoc)
+	rpcConn := newTestConn(t, server, wsrpc.NewWebsocketRPC())
+	for i := 0; i < 20; i++ {
+		err := rpcConn.NotifyExplicitly("append", documentEdit{Doc: "doc" + fmt.Sprint(i%2), Value: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for d := 0; d < 2; d++ {
+		var values []int
+		err := rpcConn.CallExplicitly("commit", documentEdit{Doc: "doc" + fmt.Sprint(d)}, &values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 10 {
+			t.Fatalf("expected 10 values but got %v", values)
+		}
+		for i, v := range values {
+			if v != i*2+d {
+				t.Fatalf("expected values in order but got %v", values)
+			}
+		}
+	}
+}
+
+func TestOrderKeyPanic(t *testing.T) {
+	server := newRPCServer()
+	reported := make(chan interface{}, 1)
+	server.PanicHandler = func(req *wsrpc.RPCRequest, recovered interface{}, stack []byte) {
+		reported <- recovered
+	}
+	server.Order("hello", func(params json.RawMessage) string {
+		var m map[string]interface{}
+		_ = json.Unmarshal(params, &m)
+		return m["doc"].(string)
+	})
+	rpcConn := newTestConn(t, server, wsrpc.NewWebsocketRPC())
+	err := rpcConn.CallLowLevel("hello", json.RawMessage(`["world"]`), nil)
+	if rpcErr, ok := err.(*wsrpc.RPCErrorInfo); !ok || rpcErr.Code != wsrpc.RPCInvalidParamsError.Code {
+		t.Errorf("expected %v but got %v", wsrpc.RPCInvalidParamsError, err)
+	}
+	select {
+	case <-reported:
+	case <-time.After(2 * time.Second):
+		t.Error("the panic is not reported")
+	}
+	var addResult addReply
+	if err := rpcConn.CallExplicitly("add", addArgs{A: 1, B: 2}, &addResult); err != nil || addResult.Result != 3 {
+		t.Errorf("expected 3 but got %v (%v)", addResult.Result, err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	rpcConn := newTestConn(t, newRPCServer(), wsrpc.NewWebsocketRPC())
+	done := make(chan error, 1)
+	go func() {
+		done <- rpcConn.CallLowLevel("sleep", json.RawMessage("[1000]"), nil)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := rpcConn.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := <-done; err != wsrpc.ErrConnectionClosed {
+		t.Errorf("expected wsrpc.ErrConnectionClosed but got %v", err)
+	}
+	if err := rpcConn.CallLowLevel("add", nil, nil); err != wsrpc.ErrConnectionClosed {
+		t.Errorf("expected wsrpc.ErrConnectionClosed but got %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	serverConn, rpcConn := newTestConnPair(t, newRPCServer(), wsrpc.NewWebsocketRPC())
+	done := make(chan error, 1)
+	go func() {
+		done <- rpcConn.CallLowLevel("sleep", json.RawMessage("[300]"), nil)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- serverConn.Shutdown(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	err := rpcConn.CallLowLevel("sleep", json.RawMessage("[0]"), nil)
+	if rpcErr, ok := err.(*wsrpc.RPCErrorInfo); !ok || rpcErr.Code != wsrpc.RPCShuttingDownError.Code {
+		t.Errorf("expected %v but got %v", wsrpc.RPCShuttingDownError, err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	server := newRPCServer()
+	connected := make(chan *wsrpc.WebsocketRPCConn, 1)
+	disconnected := make(chan error, 1)
+	server.OnConnect = func(rpcConn *wsrpc.WebsocketRPCConn) {
+		connected <- rpcConn
+	}
+	server.OnDisconnect = func(rpcConn *wsrpc.WebsocketRPCConn, err error) {
+		disconnected <- err
+	}
+	rpcConn := newTestConn(t, server, wsrpc.NewWebsocketRPC())
+	serverConn := <-connected
+	if serverConn.Err() != nil {
+		t.Errorf("expected nil but got %v", serverConn.Err())
+	}
+	_ = rpcConn.Close()
+	select {
+	case <-rpcConn.Done():
+	default:
+		t.Error("expected Done to be closed after Close")
+	}
+	if rpcConn.Err() != wsrpc.ErrConnectionClosed {
+		t.Errorf("expected wsrpc.ErrConnectionClosed but got %v", rpcConn.Err())
+	}
+	select {
+	case <-serverConn.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("the server failed to detect the disconnection")
+	}
+	if err := <-disconnected; err == nil || err != serverConn.Err() {
+		t.Errorf("expected the read error but got %v", err)
+	}
+}
+
+func TestCloseOnDisconnect(t *testing.T) {
+	server := wsrpc.NewWebsocketRPC()
+	connected := make(chan struct{}, 1)
+	disconnected := make(chan struct{}, 1)
+	server.OnConnect = func(rpcConn *wsrpc.WebsocketRPCConn) {
+		connected <- struct{}{}
+	}
+	server.OnDisconnect = func(rpcConn *wsrpc.WebsocketRPCConn, err error) {
+		_ = rpcConn.Close()
+		disconnected <- struct{}{}
+	}
+	a, b := wsrpc.NewPipe()
+	serverConn := server.ConnectAdapter(a)
+	served := make(chan struct{})
+	go func() {
+		serverConn.ServeConn()
+		close(served)
+	}()
+	<-connected
+	_ = b.Close()
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServeConn did not return when OnDisconnect closes the connection")
+	}
+	<-disconnected
+
+	// The hooks are skipped for a connection closed before serving
+	a, _ = wsrpc.NewPipe()
+	_ = server.ConnectAdapter(a).Close()
+	select {
+	case <-disconnected:
+		t.Error("expected OnDisconnect not to be called without OnConnect")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	server := newRPCServer()
+	server.TrackConnections = true
+	received := make(chan string, 4)
+	client := wsrpc.NewWebsocketRPC()
+	client.Register("news", func(text string) {
+		received <- text
+	}, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	serverConn, _ := newTestConnPair(t, server, client)
+	newTestConnPair(t, server, client)
+	if count := server.ConnectionCount(); count != 2 {
+		t.Fatalf("expected 2 connections but got %v", count)
+	}
+	failed, err := server.Broadcast("news", []string{"all"})
+	if err != nil || failed != nil {
+		t.Fatal(err, failed)
+	}
+	serverConn.Session.Set("vip", true)
+	_, err = server.BroadcastFilter("news", []string{"vip"}, func(rpcConn *wsrpc.WebsocketRPCConn) bool {
+		vip, _ := rpcConn.Session.GetBool("vip")
+		return vip
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for i := 0; i < 3; i++ {
+		select {
+		case text := <-received:
+			texts = append(texts, text)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected 3 notifications but got %v", texts)
+		}
+	}
+	_ = serverConn.Close()
+	if count := server.ConnectionCount(); count != 1 {
+		t.Errorf("expected 1 connection but got %v", count)
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	server := newRPCServer()
+	server.EnableSubscriptions()
+	rpcConn := newTestConn(t, server, wsrpc.NewWebsocketRPC())
+	sub, err := rpcConn.Subscribe("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan json.RawMessage, 1)
+	_, err = rpcConn.SubscribeFunc("news", func(payload json.RawMessage) {
+		received <- payload
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := server.Publish("news", "hello")
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 subscribers but got %v (%v)", n, err)
+	}
+	for _, ch := range []<-chan json.RawMessage{sub.C, received} {
+		select {
+		case payload := <-ch:
+			if string(payload) != `"hello"` {
+				t.Errorf("expected \"hello\" but got %s", payload)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("the subscriber failed to receive the payload")
+		}
+	}
+	if err := sub.Unsubscribe(); err != nil {
+		t.Error(err)
+	}
+	if _, ok := <-sub.C; ok {
+		t.Error("expected C to be closed after Unsubscribe")
+	}
+	if n, _ := server.Publish("news", "bye"); n != 1 {
+		t.Errorf("expected 1 subscriber but got %v", n)
+	}
+	_ = rpcConn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if n, _ := server.Publish("news", "bye"); n != 0 {
+		t.Errorf("expected no subscriber but got %v", n)
+	}
+}
+
+func TestSubscriptionOrphans(t *testing.T) {
+	a, peer := wsrpc.NewPipe()
+	rpcConn := wsrpc.NewWebsocketRPC().ConnectAdapter(a)
+	go rpcConn.ServeConn()
+	t.Cleanup(func() { _ = rpcConn.Close() })
+	// respond plays the server, which sends the notifications before the response of rpc.subscribe
+	respond := func(id string, notifications ...string) {
+		data, err := peer.ReadMessage()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var req struct {
+			ID json.RawMessage `json:"id"`
+		}
+		_ = json.Unmarshal(data, &req)
+		for _, n := range notifications {
+			_ = peer.WriteMessage([]byte(n))
+		}
+		_ = peer.WriteMessage([]byte(`{"jsonrpc":"2.0","id":` + string(req.ID) + `,"result":"` + id + `"}`))
+	}
+	notification := func(id string, payload int) string {
+		return fmt.Sprintf(`{"jsonrpc":"2.0","method":"rpc.subscription","params":{"subscription":"%v","result":%v}}`, id, payload)
+	}
+	// The notifications of other subscriptions are buffered while subscribing, and expired after that
+	var stale []string
+	for i := 0; i < 20; i++ {
+		stale = append(stale, notification(fmt.Sprint("stale", i), i))
+	}
+	go respond("first", stale...)
+	if _, err := rpcConn.Subscribe("first"); err != nil {
+		t.Fatal(err)
+	}
+	go respond("second", notification("second", 42))
+	sub, err := rpcConn.Subscribe("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case payload := <-sub.C:
+		if string(payload) != "42" {
+			t.Errorf("expected 42 but got %s", payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("the early notification is lost")
+	}
+}
+
+func TestSubscriptionSlowConsumer(t *testing.T) {
+	server := newRPCServer()
+	server.EnableSubscriptions()
+	rpcConn := newTestConn(t, server, wsrpc.NewWebsocketRPC())
+	sub, err := rpcConn.Subscribe("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if n, err := server.Publish("news", i); err != nil || n != 1 {
+			t.Fatalf("expected 1 subscriber but got %v (%v)", n, err)
+		}
+	}
+	// Calls still work while nobody reads C
+	var addResult addReply
+	if err := rpcConn.CallExplicitly("add", addArgs{A: 1, B: 2}, &addResult); err != nil || addResult.Result != 3 {
+		t.Fatalf("expected 3 but got %v (%v)", addResult.Result, err)
+	}
+	if buffered, dropped := len(sub.C), sub.Dropped(); buffered+int(dropped) != 100 || dropped == 0 {
+		t.Errorf("expected 100 payloads buffered or dropped but got %v and %v", buffered, dropped)
+	}
+	if payload := <-sub.C; string(payload) != "0" {
+		t.Errorf("expected the first payload but got %s", payload)
+	}
+}
+
+func TestStream(t *testing.T) {
+	server := newRPCServer()
+	server.Register("count", func(stream *wsrpc.RPCStream, n int) (int, error) {
+		for i := 1; i <= n; i++ {
+			if err := stream.Progress(wsrpc.RPCProgress{Current: float64(i), Total: float64(n)}); err != nil {
+				return 0, err
+			}
+			if err := stream.Send(i); err != nil {
+				return 0, err
+			}
+		}
+		return n, nil
+	}, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	rpcConn := newTestConn(t, server, wsrpc.NewWebsocketRPC())
+	call, err := rpcConn.CallStreamExplicitly(context.Background(), "count", []int{3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var partials []string
+	progress := 0
+	for item := range call.C {
+		if item.Progress != nil {
+			progress++
+			continue
+		}
+		partials = append(partials, string(item.Result))
+	}
+	if strings.Join(partials, ",") != "1,2,3" || progress != 3 {
+		t.Errorf("expected partial results 1,2,3 with 3 progress but got %v with %v", partials, progress)
+	}
+	var result []int
+	if err := call.WaitExplicitly(&result); err != nil || len(result) != 1 || result[0] != 3 {
+		t.Errorf("expected [3] but got %v (%v)", result, err)
+	}
+
+	// A stream consumer which falls behind does not stall the other calls
+	call, err = rpcConn.CallStreamExplicitly(context.Background(), "count", []int{200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var addResult addReply
+	if err := rpcConn.CallExplicitlyContext(ctx, "add", addArgs{A: 1, B: 2}, &addResult); err != nil || addResult.Result != 3 {
+		t.Errorf("expected 3 but got %v (%v)", addResult.Result, err)
+	}
+	partials = nil
+	for item := range call.C {
+		if item.Progress == nil {
+			partials = append(partials, string(item.Result))
+		}
+	}
+	if len(partials) != 200 || partials[199] != "200" {
+		t.Errorf("expected 200 partial results in order but got %v", len(partials))
+	}
+	if err := call.WaitExplicitly(&result); err != nil || len(result) != 1 || result[0] != 200 {
+		t.Errorf("expected [200] but got %v (%v)", result, err)
+	}
+}
+
+type sessionUser struct {
+	Name string
+}
+
+var sessionUserKey = wsrpc.NewSessionKey("user", &sessionUser{})
+
+func TestSession(t *testing.T) {
+	server := newRPCServer()
+	server.Register("whoami", func(rpcConn *wsrpc.WebsocketRPCConn) string {
+		var user *sessionUser
+		if !sessionUserKey.Load(rpcConn.Session, &user) {
+			return ""
+		}
+		return user.Name + "@" + rpcConn.Value().(string)
+	}, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	server.Register("incr", func(rpcConn *wsrpc.WebsocketRPCConn) {
+		rpcConn.Session.LoadOrStore("counter", new(int64))
+	}, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	upgrader := websocket.Upgrader{}
+	changes := make(chan string, 16)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		c, err := upgrader.Upgrade(writer, request, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		rpcConn := server.Connect(c, wsrpc.WithValue("test"))
+		rpcConn.Session.OnChange(func(key string, oldValue interface{}, newValue interface{}) {
+			changes <- key
+		})
+		if err := sessionUserKey.Set(rpcConn.Session, "alice"); err == nil {
+			t.Error("expected an error when setting a value of wrong type")
+		}
+		_ = sessionUserKey.Set(rpcConn.Session, &sessionUser{Name: "alice"})
+		rpcConn.ServeConn()
+	}))
+	t.Cleanup(httpServer.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcConn := wsrpc.NewWebsocketRPC().Connect(conn)
+	go rpcConn.ServeConn()
+	t.Cleanup(func() { _ = rpcConn.Close() })
+	var name []string
+	if err := rpcConn.CallExplicitly("whoami", []int{}, &name); err != nil || len(name) != 1 || name[0] != "alice@test" {
+		t.Errorf("expected [alice@test] but got %v (%v)", name, err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = rpcConn.CallLowLevel("incr", json.RawMessage("[]"), nil)
+		}()
+	}
+	wg.Wait()
+	var keys []string
+	for len(changes) > 0 {
+		keys = append(keys, <-changes)
+	}
+	if strings.Join(keys, ",") != "user,counter" {
+		t.Errorf("expected changes of user,counter but got %v", keys)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	server := newRPCServer()
+	server.RegisterLogin("login", func(_ context.Context, _ *wsrpc.WebsocketRPCConn, params json.RawMessage) (wsrpc.RPCPrincipal, error) {
+		var args []string
+		if err := json.Unmarshal(params, &args); err != nil || len(args) != 2 || args[1] != "secret" {
+			return nil, errors.New("invalid credentials")
+		}
+		return wsrpc.NewRPCPrincipal(args[0], "math"), nil
+	})
+	// A middleware added earlier cannot bypass the rules
+	err := server.UseFor("doc/*", func(next wsrpc.RPCHandler) wsrpc.RPCHandler {
+		return func(req *wsrpc.RPCRequest, reply *json.RawMessage) error {
+			if req.Method == "doc/cached" {
+				*reply = json.RawMessage(`["cached"]`)
+				return nil
+			}
+			return next(req, reply)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Register("doc/cached", func() string {
+		return "fresh"
+	}, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	if err := server.RequireAuthentication("*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RequirePermission("hello", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RequirePermission("doc/*/write", "editor"); err != nil {
+		t.Fatal(err)
+	}
+	server.Register("doc/secret", func() string {
+		return "secret"
+	}, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	server.Register("doc/a/b/write", func() string {
+		return "written"
+	}, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	rpcConn := newTestConn(t, server, wsrpc.NewWebsocketRPC())
+	isError := func(err error, expected wsrpc.RPCErrorInfo) bool {
+		rpcErr, ok := err.(*wsrpc.RPCErrorInfo)
+		return ok && rpcErr.Code == expected.Code
+	}
+	var addResult addReply
+	if err := rpcConn.CallExplicitly("add", addArgs{A: 1, B: 2}, &addResult); !isError(err, wsrpc.RPCUnauthorizedError) {
+		t.Errorf("expected unauthorized error but got %v", err)
+	}
+	if err := rpcConn.CallLowLevel("doc/secret", nil, nil); !isError(err, wsrpc.RPCUnauthorizedError) {
+		t.Errorf("expected unauthorized error for a method containing `/` but got %v", err)
+	}
+	if err := rpcConn.CallLowLevel("doc/cached", nil, nil); !isError(err, wsrpc.RPCUnauthorizedError) {
+		t.Errorf("expected unauthorized error before the middleware but got %v", err)
+	}
+	var name string
+	if err := rpcConn.CallExplicitly("login", []string{"alice", "wrong"}, &name); !isError(err, wsrpc.RPCUnauthorizedError) {
+		t.Errorf("expected unauthorized error but got %v", err)
+	}
+	if err := rpcConn.CallExplicitly("login", []string{"alice", "secret"}, &name); err != nil || name != "alice" {
+		t.Fatalf("expected alice but got %v (%v)", name, err)
+	}
+	if err := rpcConn.CallExplicitly("add", addArgs{A: 1, B: 2}, &addResult); err != nil || addResult.Result != 3 {
+		t.Errorf("expected 3 but got %v (%v)", addResult.Result, err)
+	}
+	if err := rpcConn.CallLowLevel("hello", json.RawMessage(`["world"]`), nil); !isError(err, wsrpc.RPCForbiddenError) {
+		t.Errorf("expected forbidden error but got %v", err)
+	}
+	if err := rpcConn.CallLowLevel("doc/a/b/write", nil, nil); !isError(err, wsrpc.RPCForbiddenError) {
+		t.Errorf("expected forbidden error but got %v", err)
+	}
+	var secret []string
+	if err := rpcConn.CallExplicitly("doc/secret", nil, &secret); err != nil || len(secret) != 1 || secret[0] != "secret" {
+		t.Errorf("expected secret but got %v (%v)", secret, err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	server := newRPCServer()
+	server.HandshakeAuthenticator = func(r *http.Request) (wsrpc.RPCPrincipal, error) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			return nil, errors.New("invalid token")
+		}
+		return wsrpc.NewRPCPrincipal("alice"), nil
+	}
+	handler := server.Handler()
+	handler.RequireSubprotocol = true
+	handler.InitSession = func(rpcConn *wsrpc.WebsocketRPCConn, r *http.Request) error {
+		rpcConn.Session.Set("foo", rpcConn.Principal().Name())
+		return nil
+	}
+	httpServer := httptest.NewServer(handler)
+	t.Cleanup(httpServer.Close)
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+	dialer := websocket.Dialer{Subprotocols: []string{wsrpc.JSONRPCSubprotocol}}
+	if _, resp, err := dialer.Dial(url, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 but got %v", err)
+	}
+	header := http.Header{"Authorization": []string{"Bearer token"}}
+	if _, resp, err := websocket.DefaultDialer.Dial(url, header); err == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 but got %v", err)
+	}
+	conn, _, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Subprotocol() != wsrpc.JSONRPCSubprotocol {
+		t.Errorf("expected subprotocol %v but got %v", wsrpc.JSONRPCSubprotocol, conn.Subprotocol())
+	}
+	rpcConn := wsrpc.NewWebsocketRPC().Connect(conn)
+	go rpcConn.ServeConn()
+	t.Cleanup(func() { _ = rpcConn.Close() })
+	var hello func(string) (string, string, error)
+	rpcConn.MakeCall("hello", &hello, wsrpc.NewRPCMixedParamsCodec([]string{"name"}), wsrpc.NewRPCPositionalParamsCodec())
+	if v, _, err := hello("world"); err != nil || v != "alice" {
+		t.Errorf("expected alice but got %v (%v)", v, err)
+	}
+}
+
+func TestDial(t *testing.T) {
+	server := newRPCServer()
+	server.Register("sleepOnce", rpcMethodSleep, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	serverConns := make(chan *wsrpc.WebsocketRPCConn, 4)
+	server.OnConnect = func(rpcConn *wsrpc.WebsocketRPCConn) {
+		serverConns <- rpcConn
+	}
+	httpServer := httptest.NewServer(server.Handler())
+	t.Cleanup(httpServer.Close)
+	reconnected := make(chan struct{}, 4)
+	rpcConn, err := wsrpc.NewWebsocketRPC().Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), &wsrpc.DialOptions{
+		MinBackoff: 10 * time.Millisecond,
+		OnReconnect: func(rpcConn *wsrpc.WebsocketRPCConn) {
+			reconnected <- struct{}{}
+		},
+		QueueWhileDisconnected: true,
+		IsIdempotent: func(method string) bool {
+			return method == "sleep"
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = rpcConn.Close() })
+	serverConn := <-serverConns
+	var addResult addReply
+	if err := rpcConn.CallExplicitly("add", addArgs{A: 1, B: 2}, &addResult); err != nil || addResult.Result != 3 {
+		t.Fatalf("expected 3 but got %v (%v)", addResult.Result, err)
+	}
+	// An idempotent call is retried when the connection is lost before its response
+	result := make(chan error, 1)
+	go func() {
+		result <- rpcConn.CallLowLevel("sleep", json.RawMessage("[200]"), nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_ = serverConn.Close()
+	if err := <-result; err != nil {
+		t.Errorf("expected the idempotent call to be retried but got %v", err)
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnReconnect is not called")
+	}
+	serverConn = <-serverConns
+	go func() {
+		result <- rpcConn.CallLowLevel("sleepOnce", json.RawMessage("[200]"), nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_ = serverConn.Close()
+	if err := <-result; err != wsrpc.ErrConnectionLost {
+		t.Errorf("expected ErrConnectionLost but got %v", err)
+	}
+	// Calls made while disconnected wait for the reconnection
+	if err := rpcConn.CallExplicitly("add", addArgs{A: 2, B: 3}, &addResult); err != nil || addResult.Result != 5 {
+		t.Errorf("expected 5 but got %v (%v)", addResult.Result, err)
+	}
+}
+
+func TestDialRelogin(t *testing.T) {
+	server := newRPCServer()
+	server.RegisterLogin("login", func(_ context.Context, _ *wsrpc.WebsocketRPCConn, _ json.RawMessage) (wsrpc.RPCPrincipal, error) {
+		return wsrpc.NewRPCPrincipal("alice"), nil
+	})
+	if err := server.RequireAuthentication("*"); err != nil {
+		t.Fatal(err)
+	}
+	serverConns := make(chan *wsrpc.WebsocketRPCConn, 4)
+	server.OnConnect = func(rpcConn *wsrpc.WebsocketRPCConn) {
+		serverConns <- rpcConn
+	}
+	var down int32
+	handler := server.Handler()
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) != 0 {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(httpServer.Close)
+	login := func(rpcConn *wsrpc.WebsocketRPCConn) error {
+		return rpcConn.CallLowLevel("login", nil, nil)
+	}
+	rpcConn, err := wsrpc.NewWebsocketRPC().Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), &wsrpc.DialOptions{
+		MinBackoff: 10 * time.Millisecond,
+		OnReconnect: func(rpcConn *wsrpc.WebsocketRPCConn) {
+			time.Sleep(100 * time.Millisecond)
+			if err := login(rpcConn); err != nil {
+				t.Error(err)
+			}
+		},
+		QueueWhileDisconnected: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = rpcConn.Close() })
+	if err := login(rpcConn); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&down, 1)
+	_ = (<-serverConns).Close()
+	time.Sleep(100 * time.Millisecond)
+	// The call is queued until OnReconnect logs in again
+	result := make(chan error, 1)
+	var addResult addReply
+	go func() {
+		result <- rpcConn.CallExplicitly("add", addArgs{A: 1, B: 2}, &addResult)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	atomic.StoreInt32(&down, 0)
+	if err := <-result; err != nil || addResult.Result != 3 {
+		t.Errorf("expected 3 but got %v (%v)", addResult.Result, err)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	server := newRPCServer()
+	disconnected := make(chan error, 1)
+	server.OnDisconnect = func(rpcConn *wsrpc.WebsocketRPCConn, err error) {
+		disconnected <- err
+	}
+	handler := server.Handler()
+	handler.PingInterval = 50 * time.Millisecond
+	handler.PongTimeout = 50 * time.Millisecond
+	httpServer := httptest.NewServer(handler)
+	t.Cleanup(httpServer.Close)
+	// The client never reads, so the pings are not answered
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case err := <-disconnected:
+		if err != wsrpc.ErrHeartbeatTimeout {
+			t.Errorf("expected ErrHeartbeatTimeout but got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("the dead peer is not detected")
+	}
+
+	// A peer which never responds is detected by the application-level heartbeat
+	upgrader := websocket.Upgrader{}
+	silentServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		c, err := upgrader.Upgrade(writer, request, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(silentServer.Close)
+	conn, _, err = websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(silentServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcConn := wsrpc.NewWebsocketRPC().Connect(conn)
+	go rpcConn.ServeConn()
+	rpcConn.StartHeartbeat(50*time.Millisecond, 50*time.Millisecond)
+	err = rpcConn.CallLowLevel("add", json.RawMessage(`{"a":1,"b":2}`), nil)
+	if err != wsrpc.ErrConnectionClosed || rpcConn.Err() != wsrpc.ErrHeartbeatTimeout {
+		t.Errorf("expected the pending call to fail by heartbeat timeout but got %v (%v)", err, rpcConn.Err())
+	}
+}
+
+func TestStreamMessageAdapter(t *testing.T) {
+	server := newRPCServer()
+	for _, framing := range []wsrpc.MessageFraming{wsrpc.FramingNewline, wsrpc.FramingContentLength, wsrpc.FramingLengthPrefix} {
+		serverSide, clientSide := net.Pipe()
+		serverConn := server.ConnectAdapter(wsrpc.NewStreamMessageAdapter(serverSide, framing))
+		go serverConn.ServeConn()
+		clientAdapter := wsrpc.NewStreamMessageAdapter(clientSide, framing)
+		clientAdapter.SetMaxFrameSize(64)
+		rpcConn := wsrpc.NewWebsocketRPC().ConnectAdapter(clientAdapter)
+		go rpcConn.ServeConn()
+		var addResult addReply
+		if err := rpcConn.CallExplicitly("add", addArgs{A: 1, B: 2}, &addResult); err != nil || addResult.Result != 3 {
+			t.Errorf("framing %v: expected 3 but got %v (%v)", framing, addResult.Result, err)
+		}
+		if err := rpcConn.NotifyExplicitly("add", strings.Repeat("x", 64)); err != wsrpc.ErrFrameTooLarge {
+			t.Errorf("framing %v: expected ErrFrameTooLarge but got %v", framing, err)
+		}
+		_ = rpcConn.Close()
+		_ = serverConn.Close()
+	}
+	for _, header := range []string{
+		"X-Long: " + strings.Repeat("x", 8<<10) + "\r\n",
+		strings.Repeat("X-Many: x\r\n", 8<<10),
+	} {
+		reader, writer := net.Pipe()
+		go func() {
+			_, _ = writer.Write([]byte(header + "Content-Length: 2\r\n\r\n{}"))
+		}()
+		adapter := wsrpc.NewStreamMessageAdapter(reader, wsrpc.FramingContentLength)
+		if _, err := adapter.ReadMessage(); err != wsrpc.ErrFrameTooLarge {
+			t.Errorf("expected ErrFrameTooLarge for large headers but got %v", err)
+		}
+		_ = reader.Close()
+		_ = writer.Close()
+	}
+	// A bogus length does not allocate the memory in advance when the size is unlimited
+	reader, writer := net.Pipe()
+	large := `"` + strings.Repeat("x", 100<<10) + `"`
+	go func() {
+		_, _ = fmt.Fprintf(writer, "Content-Length: %v\r\n\r\n%v", len(large), large)
+		_, _ = writer.Write([]byte("Content-Length: 9000000000000000000\r\n\r\n{}"))
+		_ = writer.Close()
+	}()
+	adapter := wsrpc.NewStreamMessageAdapter(reader, wsrpc.FramingContentLength)
+	adapter.SetMaxFrameSize(0)
+	if message, err := adapter.ReadMessage(); err != nil || string(message) != large {
+		t.Errorf("expected a large message but got %v bytes (%v)", len(message), err)
+	}
+	if _, err := adapter.ReadMessage(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF but got %v", err)
+	}
+}
+
+// TestHelperProcess is run as a child process by TestProcessMessageAdapter
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("WSRPC_HELPER_PROCESS") != "1" {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "helper started")
+	server := newRPCServer()
+	server.Register("exit", os.Exit, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	rpcConn := server.ConnectAdapter(wsrpc.NewStdioMessageAdapter())
 	rpcConn.ServeConn()
+	os.Exit(0)
+}
+
+type syncBuffer struct {
+	mux sync.Mutex
+	buf strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.String()
+}
+
+func TestProcessMessageAdapter(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcess")
+	cmd.Env = append(os.Environ(), "WSRPC_HELPER_PROCESS=1")
+	var stderr syncBuffer
+	adapter, err := wsrpc.NewProcessMessageAdapter(cmd, log.New(&stderr, "helper: ", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcConn := wsrpc.NewWebsocketRPC().ConnectAdapter(adapter)
+	go rpcConn.ServeConn()
+	var addResult addReply
+	if err := rpcConn.CallExplicitly("add", addArgs{A: 1, B: 2}, &addResult); err != nil || addResult.Result != 3 {
+		t.Errorf("expected 3 but got %v (%v)", addResult.Result, err)
+	}
+	// The exit of the child closes the connection
+	_ = rpcConn.NotifyExplicitly("exit", []int{3})
+	select {
+	case <-rpcConn.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection is not closed after the process exits")
+	}
+	if exitErr, ok := rpcConn.Err().(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+		t.Errorf("expected exit code 3 but got %v", rpcConn.Err())
+	}
+	if !strings.Contains(stderr.String(), "helper: helper started") {
+		t.Errorf("expected stderr to be forwarded but got %q", stderr.String())
+	}
+	_ = rpcConn.Close()
+}
+
+func TestPipe(t *testing.T) {
+	server := newRPCServer()
+	client := wsrpc.NewWebsocketRPC()
+	client.Register("add", rpcMethodAdd, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	serverConn, rpcConn := wsrpc.NewPipeConns(server, client, &wsrpc.PipeOptions{Latency: time.Millisecond})
+	defer rpcConn.Close()
+	var addResult addReply
+	if err := rpcConn.CallExplicitly("add", addArgs{A: 1, B: 2}, &addResult); err != nil || addResult.Result != 3 {
+		t.Errorf("expected 3 but got %v (%v)", addResult.Result, err)
+	}
+	var sum []int
+	if err := serverConn.CallExplicitly("add", []int{2, 3}, &sum); err != nil || len(sum) != 1 || sum[0] != 5 {
+		t.Errorf("expected [5] but got %v (%v)", sum, err)
+	}
+	_ = serverConn.Close()
+	select {
+	case <-rpcConn.Done():
+	case <-time.After(time.Second):
+		t.Error("closing one end does not close the other")
+	}
+
+	// Messages are dropped
+	_, rpcConn = wsrpc.NewPipeConns(server, client, &wsrpc.PipeOptions{DropRate: 1})
+	defer rpcConn.Close()
+	rpcConn.Timeout = 50 * time.Millisecond
+	if err := rpcConn.CallExplicitly("add", addArgs{A: 1, B: 2}, &addResult); err == nil {
+		t.Error("expected the call to time out")
+	}
+
+	// Messages are reordered only if Reorder is set
+	for _, reorder := range []bool{false, true} {
+		a, b := wsrpc.NewPipeWithOptions(wsrpc.PipeOptions{Jitter: 10 * time.Millisecond, Reorder: reorder, Seed: 1})
+		for i := 0; i < 20; i++ {
+			if err := a.WriteMessage([]byte(fmt.Sprint(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		inOrder := true
+		for i := 0; i < 20; i++ {
+			msg, err := b.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg) != fmt.Sprint(i) {
+				inOrder = false
+			}
+		}
+		if inOrder == reorder {
+			t.Errorf("expected messages to be in order: %v, but got %v", !reorder, inOrder)
+		}
+		_ = a.Close()
+	}
+	// Messages whose jitter comes out as zero do not overtake the delayed ones
+	a, b := wsrpc.NewPipeWithOptions(wsrpc.PipeOptions{Jitter: 2, Seed: 1})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			if err := a.WriteMessage([]byte(fmt.Sprint(i))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		msg, err := b.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != fmt.Sprint(i) {
+			t.Fatalf("expected message %v but got %s", i, msg)
+		}
+	}
+	_ = a.Close()
+}
+
+func TestHTTPHandler(t *testing.T) {
+	handler := newRPCServer().HTTPHandler()
+	handler.InitSession = func(rpcConn *wsrpc.WebsocketRPCConn, r *http.Request) error {
+		rpcConn.Session.Set("foo", r.Header.Get("X-Foo"))
+		return nil
+	}
+	httpServer := httptest.NewServer(handler)
+	t.Cleanup(httpServer.Close)
+	post := func(body string) (int, string) {
+		req, err := http.NewRequest(http.MethodPost, httpServer.URL, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Foo", "Hi")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		result, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(result)
+	}
+	cases := []struct {
+		body   string
+		status int
+		result string
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"add","params":{"a":1,"b":2}}`, http.StatusOK, `{"id":1,"jsonrpc":"2.0","result":{"result":3}}`},
+		{`[{"jsonrpc":"2.0","id":1,"method":"hello","params":["world"]},{"jsonrpc":"2.0","method":"receive_notification"}]`, http.StatusOK, `[{"id":1,"jsonrpc":"2.0","result":["Hi","world"]}]`},
+		{`[{"jsonrpc":"2.0","method":"receive_notification"}]`, http.StatusNoContent, ``},
+		{`{"jsonrpc":"2.0",`, http.StatusBadRequest, `{"id":null,"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"}}`},
+	}
+	for _, c := range cases {
+		status, result := post(c.body)
+		if status != c.status || result != c.result {
+			t.Errorf("%v: expected %v %v but got %v %v", c.body, c.status, c.result, status, result)
+		}
+	}
+	resp, err := http.Get(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 but got %v", resp.StatusCode)
+	}
+}
+
+func TestHTTPHandlerOverload(t *testing.T) {
+	server := newRPCServer()
+	server.MaxConcurrency = 1
+	server.OverloadPolicy = wsrpc.OverloadReject
+	httpServer := httptest.NewServer(server.HTTPHandler())
+	t.Cleanup(httpServer.Close)
+	post := func(body string) (int, string) {
+		resp, err := http.Post(httpServer.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Error(err)
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		result, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(result)
+	}
+	done := make(chan int, 1)
+	go func() {
+		status, _ := post(`{"jsonrpc":"2.0","id":1,"method":"sleep","params":[300]}`)
+		done <- status
+	}()
+	for i := 0; server.Stats().Running != 1; i++ {
+		if i > 100 {
+			t.Fatal("the request did not take a worker")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	status, result := post(`{"jsonrpc":"2.0","id":2,"method":"add","params":{"a":1,"b":2}}`)
+	if status != http.StatusServiceUnavailable || !strings.Contains(result, fmt.Sprint(wsrpc.RPCServerBusyError.Code)) {
+		t.Errorf("expected status 503 with %v but got %v %v", wsrpc.RPCServerBusyError, status, result)
+	}
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("expected status 200 but got %v", status)
+	}
+	if rejected := server.Stats().Rejected; rejected != 1 {
+		t.Errorf("expected 1 rejected message but got %v", rejected)
+	}
+}
+
+func TestSSE(t *testing.T) {
+	server := newRPCServer()
+	serverConns := make(chan *wsrpc.WebsocketRPCConn, 1)
+	server.OnConnect = func(rpcConn *wsrpc.WebsocketRPCConn) {
+		serverConns <- rpcConn
+	}
+	handler := server.SSEHandler()
+	handler.InitSession = func(rpcConn *wsrpc.WebsocketRPCConn, r *http.Request) error {
+		rpcConn.Session.Set("foo", "Hello")
+		return nil
+	}
+	httpServer := httptest.NewServer(handler)
+	t.Cleanup(httpServer.Close)
+	adapter, err := wsrpc.NewSSEMessageAdapter(httpServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := wsrpc.NewWebsocketRPC()
+	client.Register("add", rpcMethodAdd, wsrpc.NewRPCPositionalParamsCodec(), wsrpc.NewRPCPositionalParamsCodec())
+	rpcConn := client.ConnectAdapter(adapter)
+	go rpcConn.ServeConn()
+	var hello func(string) (string, string, error)
+	rpcConn.MakeCall("hello", &hello, wsrpc.NewRPCMixedParamsCodec([]string{"name"}), wsrpc.NewRPCPositionalParamsCodec())
+	if v1, v2, err := hello("world"); err != nil || v1 != "Hello" || v2 != "world" {
+		t.Errorf("expected Hello world but got %v %v (%v)", v1, v2, err)
+	}
+	// The server calls the client over the SSE stream
+	serverConn := <-serverConns
+	var sum []int
+	if err := serverConn.CallExplicitly("add", []int{2, 3}, &sum); err != nil || len(sum) != 1 || sum[0] != 5 {
+		t.Errorf("expected [5] but got %v (%v)", sum, err)
+	}
+	_ = rpcConn.Close()
+	select {
+	case <-serverConn.Done():
+	case <-time.After(2 * time.Second):
+		t.Error("the connection on the server side is not closed with the stream")
+	}
 }
@@ -2,11 +2,13 @@ package wsrpc
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"reflect"
 )
 
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
 var jsonNullValue = json.RawMessage([]byte("null"))
 
 // IsJSONArray checks the input whether it is a JSON array or not.